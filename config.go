@@ -4,6 +4,9 @@ import (
 	"encoding/json"
 	"fmt"
 	"os"
+	"time"
+
+	"github.com/yakushou730/golang-web-course/models"
 )
 
 type PostgresConfig struct {
@@ -20,6 +23,216 @@ type MailgunConfig struct {
 	Domain       string `json:"domain"`
 }
 
+// ImageConfig holds the sizes, in pixels, of the resized
+// variants created for every uploaded image along with the
+// limits uploads must fit within. Limits left at zero use the
+// defaults from the models package.
+//
+// Collision is one of "rename", "replace" or "reject" and
+// decides what happens when an upload has the same filename
+// as an existing image. It defaults to "rename".
+//
+// Image URLs are signed with the HMAC key and stay valid for
+// URLTTL seconds, defaulting to an hour.
+type ImageConfig struct {
+	ThumbSize   int          `json:"thumb_size"`
+	DisplaySize int          `json:"display_size"`
+	MaxBytes    int64        `json:"max_bytes"`
+	MaxWidth    int          `json:"max_width"`
+	MaxHeight   int          `json:"max_height"`
+	Collision   string       `json:"collision"`
+	URLTTL      int          `json:"url_ttl"`
+	Resize      ResizeConfig `json:"resize"`
+	// DefaultQuota is how many bytes of images each user may
+	// store unless they have their own quota. 0 means no limit.
+	DefaultQuota int64 `json:"default_quota"`
+	// Quotas gives users their own quota by user ID, which is
+	// set every time the app starts. A quota of 0 goes back to
+	// the default, and a negative one means no limit, so
+	// removing a user from Quotas doesn't undo their quota.
+	Quotas map[uint]int64 `json:"quotas"`
+}
+
+// ResizeConfig controls resizing images on request. Sizes
+// lists the widths and heights that may be asked for, and
+// resized images are cached in CacheDir until they take up
+// more than CacheBytes. Leaving CacheDir empty turns the cache
+// off.
+type ResizeConfig struct {
+	Sizes      []int  `json:"sizes"`
+	CacheDir   string `json:"cache_dir"`
+	CacheBytes int64  `json:"cache_bytes"`
+}
+
+// Cache creates the models.ResizeCache described by the
+// config, or returns nil if there shouldn't be one.
+func (c ResizeConfig) Cache() (*models.ResizeCache, error) {
+	if c.CacheDir == "" {
+		return nil, nil
+	}
+	maxBytes := c.CacheBytes
+	if maxBytes <= 0 {
+		maxBytes = DefaultResizeConfig().CacheBytes
+	}
+	return models.NewResizeCache(c.CacheDir, maxBytes)
+}
+
+func DefaultResizeConfig() ResizeConfig {
+	return ResizeConfig{
+		CacheDir:   "cache/resized",
+		CacheBytes: 1 << 30, // 1 gigabyte
+	}
+}
+
+func DefaultImageConfig() ImageConfig {
+	return ImageConfig{
+		ThumbSize:    200,
+		DisplaySize:  1200,
+		Resize:       DefaultResizeConfig(),
+		DefaultQuota: 1 << 30, // 1 gigabyte
+	}
+}
+
+// Variants returns the image variants to create on upload.
+// Any size that wasn't set in the config uses its default.
+func (c ImageConfig) Variants() []models.ImageVariant {
+	def := DefaultImageConfig()
+	if c.ThumbSize <= 0 {
+		c.ThumbSize = def.ThumbSize
+	}
+	if c.DisplaySize <= 0 {
+		c.DisplaySize = def.DisplaySize
+	}
+	return []models.ImageVariant{
+		{Name: models.ThumbVariant, MaxSize: c.ThumbSize},
+		{Name: models.DisplayVariant, MaxSize: c.DisplaySize},
+	}
+}
+
+// URLSigner returns the signer used for image URLs.
+func (c ImageConfig) URLSigner(key string) *models.URLSigner {
+	return models.NewURLSigner(key, time.Duration(c.URLTTL)*time.Second)
+}
+
+// UploadConfig controls resumable uploads. Unfinished uploads
+// are kept in Dir, and removed once they are ExpiryHours old.
+type UploadConfig struct {
+	Dir         string `json:"dir"`
+	ExpiryHours int    `json:"expiry_hours"`
+}
+
+func DefaultUploadConfig() UploadConfig {
+	return UploadConfig{
+		Dir:         "uploads",
+		ExpiryHours: 7 * 24,
+	}
+}
+
+// Store creates the models.UploadStore described by the config.
+func (c UploadConfig) Store() (*models.UploadStore, error) {
+	dir := c.Dir
+	if dir == "" {
+		dir = DefaultUploadConfig().Dir
+	}
+	return models.NewUploadStore(dir, time.Duration(c.ExpiryHours)*time.Hour)
+}
+
+// JobsConfig controls the background jobs. Workers is how
+// many jobs run at once.
+type JobsConfig struct {
+	Workers int `json:"workers"`
+}
+
+func DefaultJobsConfig() JobsConfig {
+	return JobsConfig{
+		Workers: models.DefaultWorkers,
+	}
+}
+
+// TrashConfig controls how long deleted galleries and images
+// are kept in the trash before they are purged for good. A
+// negative RetentionDays keeps them until they are purged by
+// hand.
+type TrashConfig struct {
+	RetentionDays int `json:"retention_days"`
+}
+
+func DefaultTrashConfig() TrashConfig {
+	return TrashConfig{
+		RetentionDays: 30,
+	}
+}
+
+// Retention returns how long items are kept in the trash, or 0
+// if they are kept until they are purged by hand.
+func (c TrashConfig) Retention() time.Duration {
+	days := c.RetentionDays
+	if days == 0 {
+		days = DefaultTrashConfig().RetentionDays
+	}
+	if days < 0 {
+		return 0
+	}
+	return time.Duration(days) * 24 * time.Hour
+}
+
+// StorageConfig decides where image data is kept. Driver is
+// either "local" (the default) or "s3".
+type StorageConfig struct {
+	Driver string             `json:"driver"`
+	Local  LocalStorageConfig `json:"local"`
+	S3     S3StorageConfig    `json:"s3"`
+}
+
+type LocalStorageConfig struct {
+	Dir string `json:"dir"`
+}
+
+// S3StorageConfig is used with any S3 compatible object store,
+// such as AWS S3 or a MinIO server.
+type S3StorageConfig struct {
+	Endpoint  string `json:"endpoint"`
+	AccessKey string `json:"access_key"`
+	SecretKey string `json:"secret_key"`
+	Bucket    string `json:"bucket"`
+	Region    string `json:"region"`
+	UseSSL    bool   `json:"use_ssl"`
+	PublicURL string `json:"public_url"`
+}
+
+func DefaultStorageConfig() StorageConfig {
+	return StorageConfig{
+		Driver: "local",
+		Local: LocalStorageConfig{
+			Dir: "images",
+		},
+	}
+}
+
+// Storage creates the models.Storage selected by the config.
+func (c StorageConfig) Storage() (models.Storage, error) {
+	switch c.Driver {
+	case "", "local":
+		dir := c.Local.Dir
+		if dir == "" {
+			dir = DefaultStorageConfig().Local.Dir
+		}
+		return models.NewLocalStorage(dir), nil
+	case "s3":
+		return models.NewS3Storage(models.S3Config{
+			Endpoint:  c.S3.Endpoint,
+			AccessKey: c.S3.AccessKey,
+			SecretKey: c.S3.SecretKey,
+			Bucket:    c.S3.Bucket,
+			Region:    c.S3.Region,
+			UseSSL:    c.S3.UseSSL,
+			PublicURL: c.S3.PublicURL,
+		})
+	default:
+		return nil, fmt.Errorf("unknown storage driver %q", c.Driver)
+	}
+}
+
 func (c PostgresConfig) Dialect() string {
 	return "postgres"
 }
@@ -53,6 +266,11 @@ type Config struct {
 	// We are adding the Database nested structure with this new field
 	Database PostgresConfig `json:"database"`
 	Mailgun  MailgunConfig  `json:"mailgun"`
+	Images   ImageConfig    `json:"images"`
+	Storage  StorageConfig  `json:"storage"`
+	Uploads  UploadConfig   `json:"uploads"`
+	Trash    TrashConfig    `json:"trash"`
+	Jobs     JobsConfig     `json:"jobs"`
 }
 
 func (c Config) IsProd() bool {
@@ -66,6 +284,11 @@ func DefaultConfig() Config {
 		Pepper:   "secret-random-string",
 		HMACKey:  "secret-hmac-key",
 		Database: DefaultPostgresConfig(),
+		Images:   DefaultImageConfig(),
+		Storage:  DefaultStorageConfig(),
+		Uploads:  DefaultUploadConfig(),
+		Trash:    DefaultTrashConfig(),
+		Jobs:     DefaultJobsConfig(),
 	}
 }
 
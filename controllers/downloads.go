@@ -0,0 +1,114 @@
+package controllers
+
+import (
+	"archive/zip"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"strings"
+	"unicode"
+
+	"github.com/yakushou730/golang-web-course/context"
+	"github.com/yakushou730/golang-web-course/models"
+)
+
+// GET /galleries/:id/download
+//
+// Download streams a ZIP of every image in the gallery. It
+// follows the same rules as Show, so anyone who can view the
+// gallery can download it. Everybody but the owner gets the
+// images with the gallery's watermark on them.
+func (g *Galleries) Download(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.galleryById(w, r)
+	if err != nil {
+		return
+	}
+	if !canViewGallery(r, g.ss, gallery) {
+		http.Error(w, "Gallery not found", http.StatusNotFound)
+		return
+	}
+	g.download(w, r, gallery)
+}
+
+// GET /g/:slug/download
+func (g *Galleries) SlugDownload(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.galleryBySlug(w, r)
+	if err != nil {
+		return
+	}
+	g.download(w, r, gallery)
+}
+
+func (g *Galleries) download(w http.ResponseWriter, r *http.Request, gallery *models.Gallery) {
+	user := context.User(r.Context())
+	owner := user != nil && user.ID == gallery.UserID
+	// Like Images.Show, owners always get their originals.
+	variant := models.DisplayVariant
+	if owner || gallery.DownloadOriginals {
+		variant = ""
+	}
+	watermark := gallery.HasWatermark() && !owner
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment",
+		map[string]string{"filename": archiveName(gallery)}))
+	zw := zip.NewWriter(w)
+	for i := range gallery.Images {
+		image := &gallery.Images[i]
+		if err := g.writeZipEntry(zw, gallery, image, variant, watermark); err != nil {
+			// The response has already started, so the best we
+			// can do is stop and leave the client with a
+			// truncated archive it will refuse to open.
+			log.Println(err)
+			return
+		}
+	}
+	if err := zw.Close(); err != nil {
+		log.Println(err)
+	}
+}
+
+func (g *Galleries) writeZipEntry(zw *zip.Writer, gallery *models.Gallery, image *models.Image, variant string, watermark bool) error {
+	var rc io.ReadCloser
+	var err error
+	if watermark {
+		rc, err = g.is.Watermarked(image, gallery, variant, nil)
+	} else {
+		rc, err = g.is.Open(image, variant)
+	}
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	// JPEG and PNG data is already compressed, so deflating it
+	// again would only cost us CPU time.
+	fw, err := zw.CreateHeader(&zip.FileHeader{
+		Name:     image.Filename,
+		Method:   zip.Store,
+		Modified: image.CreatedAt,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(fw, rc)
+	return err
+}
+
+// archiveName returns the filename to suggest for the ZIP of a
+// gallery, built from its title.
+func archiveName(gallery *models.Gallery) string {
+	name := strings.Map(func(r rune) rune {
+		switch {
+		case unicode.IsLetter(r), unicode.IsDigit(r), r == '-', r == '_':
+			return r
+		case unicode.IsSpace(r):
+			return '-'
+		}
+		return -1
+	}, gallery.Title)
+	if name == "" {
+		name = fmt.Sprintf("gallery-%d", gallery.ID)
+	}
+	return name + ".zip"
+}
@@ -5,6 +5,7 @@ import (
 	"log"
 	"net/http"
 	"strconv"
+	"strings"
 
 	"github.com/gorilla/mux"
 
@@ -23,28 +24,91 @@ const (
 )
 
 type Galleries struct {
-	New       *views.View
-	ShowView  *views.View
-	EditView  *views.View
-	IndexView *views.View
-	gs        models.GalleryService
-	is        models.ImageService
-	r         *mux.Router
+	New           *views.View
+	ShowView      *views.View
+	EditView      *views.View
+	IndexView     *views.View
+	ImageShowView *views.View
+	SearchView    *views.View
+	ShareView     *views.View
+	gs            models.GalleryService
+	is            models.ImageService
+	js            models.JobService
+	ss            models.ShareLinkService
+	r             *mux.Router
+	// isProd makes the cookies share links set HTTPS only.
+	isProd bool
 }
 
 type GalleryForm struct {
-	Title string `schema:"title"`
+	Title             string `schema:"title"`
+	KeepGPS           bool   `schema:"keep_gps"`
+	SortMode          string `schema:"sort_mode"`
+	DownloadOriginals bool   `schema:"download_originals"`
+	Visibility        string `schema:"visibility"`
 }
 
-func NewGalleries(gs models.GalleryService, is models.ImageService, r *mux.Router) *Galleries {
+// CoverForm holds the ID of the image to use as the cover of
+// a gallery, or 0 to go back to using its first image.
+type CoverForm struct {
+	ImageID uint `schema:"image_id"`
+}
+
+// ImageForm is used to edit the text shown with an image.
+type ImageForm struct {
+	Title   string `schema:"title"`
+	Caption string `schema:"caption"`
+	AltText string `schema:"alt_text"`
+}
+
+// SearchForm holds the query used to search images.
+type SearchForm struct {
+	Query string `schema:"q"`
+}
+
+// ImageTransferForm is used to move or copy the selected
+// images to another gallery. Action is either "move" or
+// "copy".
+type ImageTransferForm struct {
+	ImageIDs  []uint `schema:"image_ids"`
+	GalleryID uint   `schema:"gallery_id"`
+	Action    string `schema:"action"`
+}
+
+// ImageOrderForm holds the IDs of every image in a gallery in
+// their new order.
+type ImageOrderForm struct {
+	Order []uint `schema:"order"`
+}
+
+// WatermarkForm holds the watermark settings of a gallery. The
+// watermark image itself is uploaded as the watermark_image
+// file, and RemoveImage goes back to using the text.
+type WatermarkForm struct {
+	Enabled     bool   `schema:"watermark_enabled"`
+	Text        string `schema:"watermark_text"`
+	Position    string `schema:"watermark_position"`
+	Opacity     int    `schema:"watermark_opacity"`
+	RemoveImage bool   `schema:"watermark_remove_image"`
+}
+
+func NewGalleries(gs models.GalleryService, is models.ImageService,
+	js models.JobService, ss models.ShareLinkService, r *mux.Router,
+	isProd bool) *Galleries {
 	return &Galleries{
-		New:       views.NewView("bootstrap", "galleries/new"),
-		ShowView:  views.NewView("bootstrap", "galleries/show"),
-		EditView:  views.NewView("bootstrap", "galleries/edit"),
-		IndexView: views.NewView("bootstrap", "galleries/index"),
-		gs:        gs,
-		is:        is,
-		r:         r,
+		New:           views.NewView("bootstrap", "galleries/new"),
+		ShowView:      views.NewView("bootstrap", "galleries/show"),
+		EditView:      views.NewView("bootstrap", "galleries/edit"),
+		IndexView:     views.NewView("bootstrap", "galleries/index"),
+		ImageShowView: views.NewView("bootstrap", "galleries/image"),
+		SearchView:    views.NewView("bootstrap", "galleries/search"),
+		ShareView:     views.NewView("bootstrap", "galleries/share"),
+		gs:            gs,
+		is:            is,
+		js:            js,
+		ss:            ss,
+		r:             r,
+		isProd:        isProd,
 	}
 }
 
@@ -93,11 +157,62 @@ func (g *Galleries) Show(w http.ResponseWriter, r *http.Request) {
 		// for us, so we just need to return here.
 		return
 	}
+	if !canViewGallery(r, g.ss, gallery) {
+		http.Error(w, "Gallery not found", http.StatusNotFound)
+		return
+	}
+	hideSlug(r, gallery)
 	var vd views.Data
 	vd.Yield = gallery
 	g.ShowView.Render(w, r, vd)
 }
 
+// GET /g/:slug
+//
+// SlugShow shows an unlisted gallery to anyone with its link.
+func (g *Galleries) SlugShow(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.galleryBySlug(w, r)
+	if err != nil {
+		return
+	}
+	for i := range gallery.Images {
+		gallery.Images[i].SetGallerySlug(gallery.Slug)
+	}
+	var vd views.Data
+	vd.Yield = gallery
+	g.ShowView.Render(w, r, vd)
+}
+
+// canViewGallery reports whether the visitor making the
+// request may view the gallery and its images when they ask for
+// it by ID. Owners can view all of their galleries, everybody
+// can view public ones, and visitors who opened one of the
+// gallery's share links can view it too. Unlisted galleries can
+// only be viewed by others at their slug, see SlugShow, so
+// anything that shows a gallery by ID should ask so it follows
+// the same rules as Show.
+func canViewGallery(r *http.Request, ss models.ShareLinkService, gallery *models.Gallery) bool {
+	user := context.User(r.Context())
+	if user != nil && user.ID == gallery.UserID {
+		return true
+	}
+	if gallery.Visibility == models.VisibilityPublic {
+		return true
+	}
+	return sharedWith(r, ss, gallery.ID)
+}
+
+// hideSlug clears the slug of a gallery viewed by ID by anybody
+// but its owner, so the links on the page use the ID as well.
+// Those visitors got in through a share link, and learning the
+// slug would let them back in after the link stopped working.
+func hideSlug(r *http.Request, gallery *models.Gallery) {
+	user := context.User(r.Context())
+	if user == nil || user.ID != gallery.UserID {
+		gallery.Slug = ""
+	}
+}
+
 func (g *Galleries) galleryById(w http.ResponseWriter, r *http.Request) (*models.Gallery, error) {
 	vars := mux.Vars(r)
 	idStr := vars["id"]
@@ -108,6 +223,20 @@ func (g *Galleries) galleryById(w http.ResponseWriter, r *http.Request) (*models
 		return nil, err
 	}
 	gallery, err := g.gs.ByID(uint(id))
+	return g.withImages(w, gallery, err)
+}
+
+// galleryBySlug looks up the unlisted gallery with the slug
+// from the path. Much like galleryById, any errors are
+// rendered for us.
+func (g *Galleries) galleryBySlug(w http.ResponseWriter, r *http.Request) (*models.Gallery, error) {
+	gallery, err := g.gs.BySlug(mux.Vars(r)["slug"])
+	return g.withImages(w, gallery, err)
+}
+
+// withImages loads the images of a gallery that was just looked
+// up, or renders the error from looking it up.
+func (g *Galleries) withImages(w http.ResponseWriter, gallery *models.Gallery, err error) (*models.Gallery, error) {
 	if err != nil {
 		switch err {
 		case models.ErrNotFound:
@@ -120,9 +249,84 @@ func (g *Galleries) galleryById(w http.ResponseWriter, r *http.Request) (*models
 	}
 	images, _ := g.is.ByGalleryID(gallery.ID)
 	gallery.Images = images
+	gallery.SortImages()
 	return gallery, nil
 }
 
+// GET /galleries/:id/images/:imageID
+func (g *Galleries) ImageShow(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.galleryById(w, r)
+	if err != nil {
+		return
+	}
+	if !canViewGallery(r, g.ss, gallery) {
+		http.Error(w, "Gallery not found", http.StatusNotFound)
+		return
+	}
+	hideSlug(r, gallery)
+	g.showImage(w, r, gallery)
+}
+
+// GET /g/:slug/images/:imageID
+func (g *Galleries) SlugImageShow(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.galleryBySlug(w, r)
+	if err != nil {
+		return
+	}
+	g.showImage(w, r, gallery)
+}
+
+// imagePage is what the image page is rendered with. The
+// gallery is only used to link back to it. Original is set when
+// the viewer may open the original image.
+type imagePage struct {
+	*models.Image
+	Gallery  *models.Gallery
+	Original bool
+}
+
+func (g *Galleries) showImage(w http.ResponseWriter, r *http.Request, gallery *models.Gallery) {
+	image, err := g.imageByID(w, r, gallery)
+	if err != nil {
+		return
+	}
+	// The slug is only left on the gallery when it was viewed at
+	// its slug or by its owner, see hideSlug.
+	image.SetGallerySlug(gallery.Slug)
+	user := context.User(r.Context())
+	owner := user != nil && user.ID == gallery.UserID
+	var vd views.Data
+	vd.Yield = imagePage{image, gallery, owner || gallery.DownloadOriginals}
+	g.ImageShowView.Render(w, r, vd)
+}
+
+// imageByID looks up the image with the imageID from the path
+// and makes sure it belongs to the gallery. Much like
+// galleryById, any errors are rendered for us.
+func (g *Galleries) imageByID(w http.ResponseWriter, r *http.Request, gallery *models.Gallery) (*models.Image, error) {
+	idStr := mux.Vars(r)["imageID"]
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		http.Error(w, "Invalid image ID", http.StatusNotFound)
+		return nil, err
+	}
+	image, err := g.is.ByID(uint(id))
+	if err == nil && image.GalleryID != gallery.ID {
+		err = models.ErrNotFound
+	}
+	if err != nil {
+		switch err {
+		case models.ErrNotFound:
+			http.Error(w, "Image not found", http.StatusNotFound)
+		default:
+			log.Println(err)
+			http.Error(w, "Whoops! Something went wrong.", http.StatusInternalServerError)
+		}
+		return nil, err
+	}
+	return image, nil
+}
+
 // GET /galleries/:id/edit
 func (g *Galleries) Edit(w http.ResponseWriter, r *http.Request) {
 	gallery, err := g.galleryById(w, r)
@@ -142,9 +346,62 @@ func (g *Galleries) Edit(w http.ResponseWriter, r *http.Request) {
 	}
 	var vd views.Data
 	vd.Yield = gallery
+	g.renderEdit(w, r, vd)
+}
+
+// editGallery is what the edit page is rendered with. Along
+// with the gallery itself it has the user's other galleries,
+// which images can be moved or copied to, and the jobs still
+// working on its images by image ID, as well as its share
+// links. NewShareLink is the URL of a share link that was just
+// created, which is the only time it can be shown.
+type editGallery struct {
+	*models.Gallery
+	Targets      []models.Gallery
+	Jobs         map[uint]*models.Job
+	ShareLinks   []models.ShareLink
+	NewShareLink string
+}
+
+// renderEdit renders the EditView for the gallery in
+// vd.Yield.
+func (g *Galleries) renderEdit(w http.ResponseWriter, r *http.Request, vd views.Data) {
+	vd.Yield = g.editData(vd.Yield.(*models.Gallery))
 	g.EditView.Render(w, r, vd)
 }
 
+func (g *Galleries) editData(gallery *models.Gallery) editGallery {
+	galleries, err := g.gs.ByUserID(gallery.UserID)
+	if err != nil {
+		// The page is still usable without the targets.
+		log.Println(err)
+	}
+	var targets []models.Gallery
+	for _, t := range galleries {
+		if t.ID != gallery.ID {
+			targets = append(targets, t)
+		}
+	}
+	jobs, err := g.js.ByGalleryID(gallery.ID)
+	if err != nil {
+		log.Println(err)
+	}
+	byImage := make(map[uint]*models.Job, len(jobs))
+	for i := range jobs {
+		byImage[jobs[i].ImageID] = &jobs[i]
+	}
+	links, err := g.ss.ByGalleryID(gallery.ID)
+	if err != nil {
+		log.Println(err)
+	}
+	return editGallery{
+		Gallery:    gallery,
+		Targets:    targets,
+		Jobs:       byImage,
+		ShareLinks: links,
+	}
+}
+
 // POST /galleries/:id/update
 func (g *Galleries) Update(w http.ResponseWriter, r *http.Request) {
 	gallery, err := g.galleryById(w, r)
@@ -164,10 +421,14 @@ func (g *Galleries) Update(w http.ResponseWriter, r *http.Request) {
 		// If there is an error we are going to render the
 		// EditView again with an alert message.
 		vd.SetAlert(err)
-		g.EditView.Render(w, r, vd)
+		g.renderEdit(w, r, vd)
 		return
 	}
 	gallery.Title = form.Title
+	gallery.KeepGPS = form.KeepGPS
+	gallery.SortMode = form.SortMode
+	gallery.DownloadOriginals = form.DownloadOriginals
+	gallery.Visibility = form.Visibility
 	err = g.gs.Update(gallery)
 	// If there is an err our alert will be an error. Otherwise
 	// we will still render an alert, but instead it will be
@@ -182,7 +443,81 @@ func (g *Galleries) Update(w http.ResponseWriter, r *http.Request) {
 	}
 	// Error or not, we are going to render the EditView with
 	// our updated information.
-	g.EditView.Render(w, r, vd)
+	gallery.SortImages()
+	g.renderEdit(w, r, vd)
+}
+
+// POST /galleries/:id/watermark
+func (g *Galleries) Watermark(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.galleryById(w, r)
+	if err != nil {
+		return
+	}
+	user := context.User(r.Context())
+	if gallery.UserID != user.ID {
+		http.Error(w, "You do not have permission to edit "+
+			"this gallery", http.StatusForbidden)
+		return
+	}
+	var vd views.Data
+	vd.Yield = gallery
+	gallery.SortImages()
+	if err := r.ParseMultipartForm(maxMultipartMem); err != nil {
+		vd.SetAlert(err)
+		g.renderEdit(w, r, vd)
+		return
+	}
+	var form WatermarkForm
+	if err := parseValues(r.PostForm, &form); err != nil {
+		vd.SetAlert(err)
+		g.renderEdit(w, r, vd)
+		return
+	}
+	oldKey := gallery.WatermarkKey
+	key := oldKey
+	if form.RemoveImage {
+		key = ""
+	}
+	if files := r.MultipartForm.File["watermark_image"]; len(files) > 0 {
+		file, err := files[0].Open()
+		if err == nil {
+			key, err = g.is.StoreWatermark(gallery.ID, file)
+			file.Close()
+		}
+		if err != nil {
+			vd.SetAlert(err)
+			g.renderEdit(w, r, vd)
+			return
+		}
+	}
+	gallery.WatermarkEnabled = form.Enabled
+	gallery.WatermarkText = form.Text
+	gallery.WatermarkPosition = form.Position
+	gallery.WatermarkOpacity = form.Opacity
+	gallery.WatermarkKey = key
+	if err := g.gs.Update(gallery); err != nil {
+		// Don't leave a new watermark image behind that nothing
+		// uses.
+		if key != oldKey && key != "" {
+			g.is.DeleteWatermark(key)
+		}
+		vd.SetAlert(err)
+		g.renderEdit(w, r, vd)
+		return
+	}
+	if oldKey != "" && key != oldKey {
+		if err := g.is.DeleteWatermark(oldKey); err != nil {
+			log.Println(err)
+		}
+	}
+	if err := g.is.ClearWatermarks(gallery.ID); err != nil {
+		log.Println(err)
+	}
+	vd.Alert = &views.Alert{
+		Level:   views.AlertLvlSuccess,
+		Message: "Watermark settings saved!",
+	}
+	g.renderEdit(w, r, vd)
 }
 
 // POST /galleries/:id/delete
@@ -214,7 +549,7 @@ func (g *Galleries) Delete(w http.ResponseWriter, r *http.Request) {
 		// is rendered correctly.
 		vd.SetAlert(err)
 		vd.Yield = gallery
-		g.EditView.Render(w, r, vd)
+		g.renderEdit(w, r, vd)
 		return
 	}
 	url, err := g.r.Get(IndexGalleries).URL()
@@ -222,7 +557,10 @@ func (g *Galleries) Delete(w http.ResponseWriter, r *http.Request) {
 		http.Redirect(w, r, "/", http.StatusFound)
 		return
 	}
-	http.Redirect(w, r, url.Path, http.StatusFound)
+	views.RedirectAlert(w, r, url.Path, http.StatusFound, views.Alert{
+		Level:   views.AlertLvlSuccess,
+		Message: "Gallery moved to the trash.",
+	})
 }
 
 // GET /galleries
@@ -234,8 +572,21 @@ func (g *Galleries) Index(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Somethings went wrong.", http.StatusInternalServerError)
 		return
 	}
+	// Missing covers aren't worth failing the page over, the
+	// galleries are just listed without them.
+	if err := g.is.SetCovers(galleries); err != nil {
+		log.Println(err)
+	}
+	usage, err := g.is.Usage(user.ID)
+	if err != nil {
+		log.Println(err)
+		usage = &models.StorageUsage{}
+	}
 	var vd views.Data
-	vd.Yield = galleries
+	vd.Yield = struct {
+		Galleries []models.Gallery
+		Usage     *models.StorageUsage
+	}{galleries, usage}
 	g.IndexView.Render(w, r, vd)
 }
 
@@ -257,38 +608,285 @@ func (g *Galleries) ImageUpload(w http.ResponseWriter, r *http.Request) {
 		// If we can't parse the form just render an error alert on the
 		// edit gallery page.
 		vd.SetAlert(err)
-		g.EditView.Render(w, r, vd)
+		g.renderEdit(w, r, vd)
 		return
 	}
 
-	// Iterate over uploaded files to process them.
+	// Iterate over uploaded files to process them. A file that
+	// fails doesn't stop the rest of the upload, we just keep
+	// track of it so we can tell the user about it afterwards.
+	var errs uploadErrors
 	files := r.MultipartForm.File["images"]
 	for _, f := range files {
 		// Open the uploaded file
 		file, err := f.Open()
 		if err != nil {
-			vd.SetAlert(err)
-			g.EditView.Render(w, r, vd)
-			return
+			errs = append(errs, uploadError{f.Filename, err})
+			continue
 		}
-		defer file.Close()
 
 		// Create the image
-		err = g.is.Create(gallery.ID, file, f.Filename)
+		image := models.Image{
+			GalleryID: gallery.ID,
+			UserID:    user.ID,
+			Filename:  f.Filename,
+			KeepGPS:   gallery.KeepGPS,
+		}
+		err = g.is.Create(&image, file)
+		file.Close()
+		if err != nil {
+			errs = append(errs, uploadError{f.Filename, err})
+		}
+	}
+	if len(errs) > 0 {
+		// Render the edit page with the images that did make it
+		// along with an alert listing the files that didn't.
+		gallery.Images, _ = g.is.ByGalleryID(gallery.ID)
+		gallery.SortImages()
+		vd.SetAlert(errs)
+		g.renderEdit(w, r, vd)
+		return
+	}
+	url, err := g.r.Get(EditGallery).URL("id", fmt.Sprintf("%v", gallery.ID))
+	if err != nil {
+		http.Redirect(w, r, "/galleries", http.StatusFound)
+		return
+	}
+	http.Redirect(w, r, url.Path, http.StatusFound)
+}
+
+// POST /galleries/:id/cover
+func (g *Galleries) Cover(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.galleryById(w, r)
+	if err != nil {
+		return
+	}
+	user := context.User(r.Context())
+	if gallery.UserID != user.ID {
+		http.Error(w, "You do not have permission to edit "+
+			"this gallery", http.StatusForbidden)
+		return
+	}
+	var vd views.Data
+	vd.Yield = gallery
+	var form CoverForm
+	if err := parseForm(r, &form); err != nil {
+		vd.SetAlert(err)
+		g.renderEdit(w, r, vd)
+		return
+	}
+	if form.ImageID > 0 {
+		// Only images in this gallery can be its cover.
+		image, err := g.is.ByID(form.ImageID)
+		if err == nil && image.GalleryID != gallery.ID {
+			err = models.ErrNotFound
+		}
 		if err != nil {
 			vd.SetAlert(err)
-			g.EditView.Render(w, r, vd)
+			g.renderEdit(w, r, vd)
 			return
 		}
 	}
+	gallery.CoverImageID = form.ImageID
+	if err := g.gs.Update(gallery); err != nil {
+		vd.SetAlert(err)
+		g.renderEdit(w, r, vd)
+		return
+	}
+	url, err := g.r.Get(EditGallery).URL("id", fmt.Sprintf("%v", gallery.ID))
+	if err != nil {
+		log.Println(err)
+		http.Redirect(w, r, "/galleries", http.StatusFound)
+		return
+	}
+	http.Redirect(w, r, url.Path, http.StatusFound)
+}
+
+// POST /galleries/:id/images/:imageID/update
+func (g *Galleries) ImageUpdate(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.galleryById(w, r)
+	if err != nil {
+		return
+	}
+	user := context.User(r.Context())
+	if gallery.UserID != user.ID {
+		http.Error(w, "You do not have permission to edit "+
+			"this gallery or image", http.StatusForbidden)
+		return
+	}
+	image, err := g.imageByID(w, r, gallery)
+	if err != nil {
+		return
+	}
+	var vd views.Data
+	vd.Yield = gallery
+	var form ImageForm
+	if err := parseForm(r, &form); err != nil {
+		vd.SetAlert(err)
+		g.renderEdit(w, r, vd)
+		return
+	}
+	image.Title = form.Title
+	image.Caption = form.Caption
+	image.AltText = form.AltText
+	if err := g.is.Update(image); err != nil {
+		vd.SetAlert(err)
+		g.renderEdit(w, r, vd)
+		return
+	}
 	url, err := g.r.Get(EditGallery).URL("id", fmt.Sprintf("%v", gallery.ID))
 	if err != nil {
+		log.Println(err)
 		http.Redirect(w, r, "/galleries", http.StatusFound)
 		return
 	}
 	http.Redirect(w, r, url.Path, http.StatusFound)
 }
 
+// GET /galleries/search?q=
+func (g *Galleries) Search(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	var vd views.Data
+	var form SearchForm
+	vd.Yield = &form
+	if err := parseURLParams(r, &form); err != nil {
+		vd.SetAlert(err)
+		g.SearchView.Render(w, r, vd)
+		return
+	}
+	form.Query = strings.TrimSpace(form.Query)
+	if form.Query == "" {
+		g.SearchView.Render(w, r, vd)
+		return
+	}
+	images, err := g.is.Search(user.ID, form.Query)
+	if err != nil {
+		vd.SetAlert(err)
+		g.SearchView.Render(w, r, vd)
+		return
+	}
+	vd.Yield = struct {
+		Query  string
+		Images []models.Image
+	}{form.Query, images}
+	g.SearchView.Render(w, r, vd)
+}
+
+// POST /galleries/:id/images/order
+func (g *Galleries) ImageOrder(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.galleryById(w, r)
+	if err != nil {
+		return
+	}
+	user := context.User(r.Context())
+	if gallery.UserID != user.ID {
+		http.Error(w, "You do not have permission to edit "+
+			"this gallery", http.StatusForbidden)
+		return
+	}
+	var vd views.Data
+	vd.Yield = gallery
+	var form ImageOrderForm
+	if err := parseForm(r, &form); err != nil {
+		vd.SetAlert(err)
+		g.renderEdit(w, r, vd)
+		return
+	}
+	if err := g.is.Reorder(gallery.ID, form.Order); err != nil {
+		vd.SetAlert(err)
+		g.renderEdit(w, r, vd)
+		return
+	}
+	// Setting an order only makes sense if the gallery uses it.
+	if gallery.SortMode != models.SortManual {
+		gallery.SortMode = models.SortManual
+		if err := g.gs.Update(gallery); err != nil {
+			vd.SetAlert(err)
+			g.renderEdit(w, r, vd)
+			return
+		}
+	}
+	url, err := g.r.Get(EditGallery).URL("id", fmt.Sprintf("%v", gallery.ID))
+	if err != nil {
+		log.Println(err)
+		http.Redirect(w, r, "/galleries", http.StatusFound)
+		return
+	}
+	http.Redirect(w, r, url.Path, http.StatusFound)
+}
+
+// POST /galleries/:id/images/transfer
+func (g *Galleries) ImageTransfer(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.galleryById(w, r)
+	if err != nil {
+		return
+	}
+	user := context.User(r.Context())
+	if gallery.UserID != user.ID {
+		http.Error(w, "You do not have permission to edit "+
+			"this gallery", http.StatusForbidden)
+		return
+	}
+	var vd views.Data
+	vd.Yield = gallery
+	var form ImageTransferForm
+	if err := parseForm(r, &form); err != nil {
+		vd.SetAlert(err)
+		g.renderEdit(w, r, vd)
+		return
+	}
+	if len(form.ImageIDs) == 0 {
+		vd.AlertError("Please select the images to move or copy.")
+		g.renderEdit(w, r, vd)
+		return
+	}
+	if form.Action != "move" && form.Action != "copy" {
+		vd.AlertError("Please choose whether to move or copy the images.")
+		g.renderEdit(w, r, vd)
+		return
+	}
+	// The destination has to belong to the user just as much as
+	// the gallery the images come from.
+	target, err := g.gs.ByID(form.GalleryID)
+	if err != nil || target.UserID != user.ID || target.ID == gallery.ID {
+		vd.AlertError("Please choose another one of your galleries.")
+		g.renderEdit(w, r, vd)
+		return
+	}
+	var errs uploadErrors
+	for _, id := range form.ImageIDs {
+		image, err := g.is.ByID(id)
+		if err != nil || image.GalleryID != gallery.ID {
+			errs = append(errs, uploadError{fmt.Sprintf("Image %d", id), models.ErrNotFound})
+			continue
+		}
+		if form.Action == "move" {
+			err = g.is.Move(image, target.ID)
+		} else {
+			_, err = g.is.Copy(image, target.ID)
+		}
+		if err != nil {
+			errs = append(errs, uploadError{image.Filename, err})
+		}
+	}
+	gallery.Images, _ = g.is.ByGalleryID(gallery.ID)
+	gallery.SortImages()
+	verb := "moved"
+	if form.Action == "copy" {
+		verb = "copied"
+	}
+	if len(errs) > 0 {
+		vd.AlertError(fmt.Sprintf("Some images could not be %s. ", verb) + errs.details())
+	} else {
+		vd.Alert = &views.Alert{
+			Level: views.AlertLvlSuccess,
+			Message: fmt.Sprintf("%d images %s to %s.",
+				len(form.ImageIDs), verb, target.Title),
+		}
+	}
+	g.renderEdit(w, r, vd)
+}
+
 // POST /galleries/:id/images/:filename/delete
 func (g *Galleries) ImageDelete(w http.ResponseWriter, r *http.Request) {
 	gallery, err := g.galleryById(w, r)
@@ -303,19 +901,21 @@ func (g *Galleries) ImageDelete(w http.ResponseWriter, r *http.Request) {
 	}
 	// Get the filename from the path
 	filename := mux.Vars(r)["filename"]
-	// Build the Image model
-	i := models.Image{
-		GalleryID: gallery.ID,
-		Filename:  filename,
+	var vd views.Data
+	vd.Yield = gallery
+	// Lookup the image record for this gallery
+	i, err := g.is.ByFilename(gallery.ID, filename)
+	if err != nil {
+		// Render the edit page with any errors.
+		vd.SetAlert(err)
+		g.renderEdit(w, r, vd)
+		return
 	}
 	// Try to delete the image.
-	err = g.is.Delete(&i)
+	err = g.is.Delete(i)
 	if err != nil {
-		// Render the edit page with any errors.
-		var vd views.Data
-		vd.Yield = gallery
 		vd.SetAlert(err)
-		g.EditView.Render(w, r, vd)
+		g.renderEdit(w, r, vd)
 		return
 	}
 	// If all goes well, redirect to the edit gallery page.
@@ -0,0 +1,279 @@
+package controllers
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"github.com/yakushou730/golang-web-course/context"
+	"github.com/yakushou730/golang-web-course/models"
+)
+
+const (
+	// maxImageCacheAge is how long browsers may cache an image
+	// URL that includes the image version.
+	maxImageCacheAge = 365 * 24 * time.Hour
+)
+
+// Images serves the image data behind the paths returned by
+// models.Image, such as Path and ThumbPath.
+type Images struct {
+	is models.ImageService
+	gs models.GalleryService
+	ss models.ShareLinkService
+}
+
+// NewImages returns the controller serving image data. Every
+// request must carry a valid signature if the ImageService
+// signs its URLs, and the viewer must be allowed to view the
+// gallery the image is in.
+func NewImages(is models.ImageService, gs models.GalleryService, ss models.ShareLinkService) *Images {
+	return &Images{
+		is: is,
+		gs: gs,
+		ss: ss,
+	}
+}
+
+// GET /images/galleries/:id/:filename
+// GET /images/galleries/:id/:filename?w=&h=&fit=
+// GET /images/:variant/galleries/:id/:filename
+//
+// Show serves image data with a strong ETag built from the
+// image's content hash, answering conditional and range
+// requests without sending the image again when it can. URLs
+// carrying the current version of the image never change, so
+// browsers are told to cache them for as long as the URL stays
+// valid.
+//
+// Unless the gallery allows downloading originals, viewers
+// other than the owner get the display variant when they ask
+// for the original.
+//
+// The original image can also be resized on request to one of
+// the sizes the ImageService allows with the w and h query
+// parameters, and fit set to "contain" (the default) or
+// "cover".
+//
+// If the gallery has a watermark it is drawn on the display
+// variant, and on everything but thumbnails for viewers other
+// than the owner, who can still get their originals as they
+// uploaded them. Resized images are made from the original, so
+// they are always watermarked for other viewers, thumbnail
+// sized or not.
+func (i *Images) Show(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	mw := &metricsWriter{ResponseWriter: w, status: http.StatusOK}
+	// The variant is empty when the original is requested.
+	variant := mux.Vars(r)["variant"]
+	defer func() {
+		imageMetrics.record(variant, mw.status, mw.bytes, time.Since(start))
+	}()
+	i.show(mw, r, variant)
+}
+
+func (i *Images) show(w http.ResponseWriter, r *http.Request, variant string) {
+	vars := mux.Vars(r)
+	galleryID, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	if err := i.is.VerifyURL(r.URL.Path, r.URL.Query()); err != nil {
+		http.Error(w, "This image link is not valid or has expired.",
+			http.StatusForbidden)
+		return
+	}
+	gallery, err := i.gs.ByID(uint(galleryID))
+	if err != nil {
+		i.renderError(w, r, err)
+		return
+	}
+	user := context.User(r.Context())
+	// The images on the pages of unlisted galleries carry the
+	// slug, which lets anybody who has it see them for as long
+	// as the gallery stays unlisted.
+	slug := models.GallerySlug(r.URL.Query())
+	unlisted := gallery.Visibility == models.VisibilityUnlisted &&
+		gallery.Slug != "" && slug == gallery.Slug
+	if !unlisted && !canViewGallery(r, i.ss, gallery) {
+		http.NotFound(w, r)
+		return
+	}
+	image, err := i.is.ByFilename(uint(galleryID), vars["filename"])
+	if err != nil {
+		i.renderError(w, r, err)
+		return
+	}
+	ro, resized, err := parseResize(r)
+	if err != nil {
+		http.Error(w, "That image size is not available.", http.StatusBadRequest)
+		return
+	}
+	owner := user != nil && user.ID == gallery.UserID
+	// Without DownloadOriginals the owner and everybody else get
+	// different data from the URL of the original, and the
+	// setting can be changed at any time.
+	mutable := variant == "" && !resized
+	if mutable && !owner && !gallery.DownloadOriginals {
+		variant = models.DisplayVariant
+	}
+	watermark := gallery.HasWatermark() && (variant == models.DisplayVariant ||
+		(!owner && (resized || variant != models.ThumbVariant)))
+	// If the storage can serve the data itself there is no
+	// reason for it to go through our application. Its URLs
+	// never expire though, and can't be taken back if the
+	// gallery stops being public, so only public galleries get
+	// them.
+	if !resized && !watermark && gallery.Visibility == models.VisibilityPublic {
+		if u := i.is.URL(image, variant); u != "" {
+			http.Redirect(w, r, u, http.StatusFound)
+			return
+		}
+	}
+	tag := variant
+	if tag == "" || image.Processing {
+		// Open serves the original until the variants are done.
+		tag = "original"
+	}
+	if resized {
+		tag = fmt.Sprintf("%dx%d-%s", ro.Width, ro.Height, ro.Fit)
+	}
+	if watermark {
+		tag += "-wm" + gallery.WatermarkVersion()
+	}
+	i.setCacheHeaders(w, r, image, tag, gallery, mutable)
+	// Most conditional requests come from browsers that already
+	// have the image, so we answer them before touching storage.
+	if etagMatches(r.Header.Get("If-None-Match"), w.Header().Get("Etag")) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	var rc io.ReadCloser
+	switch {
+	case watermark && resized:
+		rc, err = i.is.Watermarked(image, gallery, variant, &ro)
+	case watermark:
+		rc, err = i.is.Watermarked(image, gallery, variant, nil)
+	case resized:
+		rc, err = i.is.Resize(image, ro)
+	default:
+		rc, err = i.is.Open(image, variant)
+	}
+	if err != nil {
+		i.renderError(w, r, err)
+		return
+	}
+	defer rc.Close()
+	w.Header().Set("Content-Type", image.ContentType)
+	// Local files and S3 objects can both seek, which lets
+	// ServeContent handle If-Modified-Since and range requests
+	// for us.
+	if rs, ok := rc.(io.ReadSeeker); ok {
+		http.ServeContent(w, r, image.Filename, image.UpdatedAt, rs)
+		return
+	}
+	io.Copy(w, rc)
+}
+
+// parseResize reads the w, h and fit query parameters used to
+// resize an image on request. resized is false if none of them
+// were given.
+func parseResize(r *http.Request) (ro models.ResizeOptions, resized bool, err error) {
+	q := r.URL.Query()
+	for _, p := range []struct {
+		name string
+		n    *int
+	}{{"w", &ro.Width}, {"h", &ro.Height}} {
+		s := q.Get(p.name)
+		if s == "" {
+			continue
+		}
+		resized = true
+		if *p.n, err = strconv.Atoi(s); err != nil || *p.n < 0 {
+			return ro, true, models.ErrResizeInvalid
+		}
+	}
+	if fit := q.Get("fit"); fit != "" {
+		resized = true
+		ro.Fit = fit
+	} else {
+		ro.Fit = models.FitContain
+	}
+	return ro, resized, nil
+}
+
+// setCacheHeaders sets the ETag, Last-Modified and
+// Cache-Control headers for the version of the image named by
+// tag, eg "thumb" or "320x0-contain", in the gallery. Only the
+// images of public galleries may be kept by shared caches.
+func (i *Images) setCacheHeaders(w http.ResponseWriter, r *http.Request, image *models.Image, tag string, gallery *models.Gallery, mutable bool) {
+	// With a watermark the owner and everybody else get
+	// different data from the same URL, which also changes with
+	// the watermark settings.
+	mutable = mutable || gallery.HasWatermark()
+	h := w.Header()
+	if image.Digest != "" {
+		h.Set("Etag", `"`+image.Digest+"-"+tag+`"`)
+	}
+	h.Set("Last-Modified", image.UpdatedAt.UTC().Format(http.TimeFormat))
+	scope := "public"
+	if gallery.Visibility != models.VisibilityPublic || mutable {
+		// Shared caches can't check who is asking.
+		scope = "private"
+	}
+	q := r.URL.Query()
+	v := image.Version()
+	if v == "" || q.Get("v") != v || image.Processing || mutable {
+		// This URL will show different data once the image is
+		// replaced, or once its variants are done, so caches
+		// have to check back every time.
+		h.Set("Cache-Control", scope+", no-cache")
+		return
+	}
+	maxAge := int64(maxImageCacheAge / time.Second)
+	if expires, err := strconv.ParseInt(q.Get("expires"), 10, 64); err == nil {
+		// There is no point caching a signed URL past its expiry.
+		if left := expires - time.Now().Unix(); left < maxAge {
+			maxAge = left
+		}
+	}
+	if maxAge < 0 {
+		maxAge = 0
+	}
+	h.Set("Cache-Control", fmt.Sprintf("%s, max-age=%d, immutable", scope, maxAge))
+}
+
+// etagMatches reports whether the If-None-Match header lists
+// the etag. As the RFC asks, weak validators are compared as
+// if they were strong.
+func etagMatches(ifNoneMatch, etag string) bool {
+	if ifNoneMatch == "" || etag == "" {
+		return false
+	}
+	for _, tag := range strings.Split(ifNoneMatch, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" || strings.TrimPrefix(tag, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
+func (i *Images) renderError(w http.ResponseWriter, r *http.Request, err error) {
+	switch err {
+	case models.ErrNotFound, models.ErrFilenameInvalid:
+		http.NotFound(w, r)
+	case models.ErrResizeInvalid:
+		http.Error(w, "That image size is not available.", http.StatusBadRequest)
+	default:
+		log.Println(err)
+		http.Error(w, "Whoops! Something went wrong.", http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,215 @@
+package controllers
+
+import (
+	"archive/zip"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/yakushou730/golang-web-course/context"
+	"github.com/yakushou730/golang-web-course/models"
+	"github.com/yakushou730/golang-web-course/views"
+)
+
+const (
+	// maxImportArchiveBytes is the largest ZIP archive we will
+	// accept for an import.
+	maxImportArchiveBytes = 1 << 30 // 1 gigabyte
+	// maxImportEntries is the most files an archive may hold.
+	maxImportEntries = 2000
+	// maxImportBytes is the most data we are willing to expand
+	// from a single archive.
+	maxImportBytes = 4 << 30 // 4 gigabytes
+	// maxImportRatio is the highest compression ratio we allow
+	// for an entry. Photos barely compress, so anything above
+	// this is far more likely to be a zip bomb than an image.
+	maxImportRatio = 100
+)
+
+// POST /galleries/:id/images/import
+//
+// ImageImport expands a ZIP archive of images into the gallery.
+// Every file in the archive is created just like a file from
+// ImageUpload, and the edit page lists what was imported and
+// which files failed.
+func (g *Galleries) ImageImport(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.galleryById(w, r)
+	if err != nil {
+		return
+	}
+	user := context.User(r.Context())
+	if gallery.UserID != user.ID {
+		http.Error(w, "Gallery not found", http.StatusNotFound)
+		return
+	}
+	var vd views.Data
+	vd.Yield = gallery
+	r.Body = http.MaxBytesReader(w, r.Body, maxImportArchiveBytes)
+	err = r.ParseMultipartForm(maxMultipartMem)
+	if err != nil {
+		vd.SetAlert(err)
+		g.renderEdit(w, r, vd)
+		return
+	}
+	f, fh, err := r.FormFile("archive")
+	if err != nil {
+		vd.AlertError("Please choose a ZIP archive to import.")
+		g.renderEdit(w, r, vd)
+		return
+	}
+	defer f.Close()
+	zr, err := zip.NewReader(f, fh.Size)
+	if err != nil {
+		vd.SetAlert(models.ErrImportArchive)
+		g.renderEdit(w, r, vd)
+		return
+	}
+	entries := importEntries(zr)
+	if len(entries) > maxImportEntries {
+		vd.SetAlert(models.ErrImportTooManyFiles)
+		g.renderEdit(w, r, vd)
+		return
+	}
+
+	var imported []string
+	var errs uploadErrors
+	budget := &importBudget{remaining: maxImportBytes}
+	for _, zf := range entries {
+		filename, err := importEntry(g.is, zf, budget, models.Image{
+			GalleryID: gallery.ID,
+			UserID:    user.ID,
+			KeepGPS:   gallery.KeepGPS,
+		})
+		if err != nil {
+			errs = append(errs, uploadError{zf.Name, err})
+			if err == models.ErrImportTooLarge {
+				// Nothing after this entry can fit either.
+				break
+			}
+			continue
+		}
+		imported = append(imported, filename)
+	}
+
+	gallery.Images, _ = g.is.ByGalleryID(gallery.ID)
+	gallery.SortImages()
+	summary := fmt.Sprintf("Imported %d of %d files.", len(imported), len(entries))
+	if len(imported) > 0 {
+		summary += " Added " + strings.Join(imported, ", ") + "."
+	}
+	if len(errs) > 0 {
+		vd.SetAlert(errs)
+		vd.Alert.Message = summary + " " + vd.Alert.Message
+	} else {
+		vd.Alert = &views.Alert{
+			Level:   views.AlertLvlSuccess,
+			Message: summary,
+		}
+	}
+	g.renderEdit(w, r, vd)
+}
+
+// importEntries returns the files in the archive that should
+// be imported. Directories and the metadata files some
+// operating systems add to archives, such as "__MACOSX/" and
+// "._photo.jpg", are skipped.
+func importEntries(zr *zip.Reader) []*zip.File {
+	var files []*zip.File
+	for _, zf := range zr.File {
+		if zf.FileInfo().IsDir() {
+			continue
+		}
+		name := strings.Replace(zf.Name, `\`, "/", -1)
+		if strings.HasPrefix(name, "__MACOSX/") ||
+			strings.HasPrefix(path.Base(name), ".") {
+			continue
+		}
+		files = append(files, zf)
+	}
+	return files
+}
+
+// importEntry creates an image from a single file in an
+// archive and returns the filename it was stored under.
+func importEntry(is models.ImageService, zf *zip.File, budget *importBudget, image models.Image) (string, error) {
+	filename, err := importFilename(zf.Name)
+	if err != nil {
+		return "", err
+	}
+	if zf.CompressedSize64 > 0 &&
+		zf.UncompressedSize64/zf.CompressedSize64 > maxImportRatio {
+		return "", models.ErrImportRatio
+	}
+	if zf.UncompressedSize64 > uint64(budget.remaining) {
+		return "", models.ErrImportTooLarge
+	}
+	rc, err := zf.Open()
+	if err != nil {
+		return "", models.ErrImportArchive
+	}
+	defer rc.Close()
+	image.Filename = filename
+	// The sizes in the archive are supplied by the client, so we
+	// count what we actually read as well.
+	err = is.Create(&image, budget.reader(rc))
+	switch err {
+	case nil:
+	case zip.ErrChecksum, zip.ErrFormat:
+		return "", models.ErrImportArchive
+	default:
+		return "", err
+	}
+	return image.Filename, nil
+}
+
+// importFilename flattens the folders inside of an archive so
+// "holiday/beach.jpg" is imported as "beach.jpg". Paths that
+// try to climb out of the archive are rejected outright rather
+// than being flattened. The result still goes through the same
+// sanitization as any other upload when the image is created.
+func importFilename(name string) (string, error) {
+	name = strings.Replace(name, `\`, "/", -1)
+	if path.IsAbs(name) || strings.Contains(name, ":") {
+		return "", models.ErrImportPath
+	}
+	for _, part := range strings.Split(name, "/") {
+		if part == ".." {
+			return "", models.ErrImportPath
+		}
+	}
+	return path.Base(name), nil
+}
+
+// importBudget keeps track of how much more data may be read
+// from an archive.
+type importBudget struct {
+	remaining int64
+}
+
+func (b *importBudget) reader(r io.Reader) io.Reader {
+	return &budgetReader{r: r, budget: b}
+}
+
+type budgetReader struct {
+	r      io.Reader
+	budget *importBudget
+}
+
+func (br *budgetReader) Read(p []byte) (int, error) {
+	if br.budget.remaining <= 0 {
+		// Only complain if there really is more data to read.
+		var b [1]byte
+		if n, err := br.r.Read(b[:]); n == 0 && err != nil {
+			return 0, err
+		}
+		return 0, models.ErrImportTooLarge
+	}
+	if int64(len(p)) > br.budget.remaining {
+		p = p[:br.budget.remaining]
+	}
+	n, err := br.r.Read(p)
+	br.budget.remaining -= int64(n)
+	return n, err
+}
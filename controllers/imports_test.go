@@ -0,0 +1,157 @@
+package controllers
+
+import (
+	"archive/zip"
+	"bytes"
+	"io/ioutil"
+	"math/rand"
+	"strings"
+	"testing"
+
+	"github.com/yakushou730/golang-web-course/models"
+)
+
+func TestImportFilename(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+		err  error
+	}{
+		{"photo.jpg", "photo.jpg", nil},
+		{"holiday/beach.jpg", "beach.jpg", nil},
+		{"a/b/c/deep.png", "deep.png", nil},
+		{`windows\folder\pic.jpg`, "pic.jpg", nil},
+		{"../escape.jpg", "", models.ErrImportPath},
+		{"holiday/../../escape.jpg", "", models.ErrImportPath},
+		{`..\escape.jpg`, "", models.ErrImportPath},
+		{"/etc/passwd", "", models.ErrImportPath},
+		{`\root.jpg`, "", models.ErrImportPath},
+		{"C:/photo.jpg", "", models.ErrImportPath},
+		{"c:photo.jpg", "", models.ErrImportPath},
+	}
+	for _, tc := range tests {
+		got, err := importFilename(tc.name)
+		if got != tc.want || err != tc.err {
+			t.Errorf("importFilename(%q) = %q, %v, want %q, %v",
+				tc.name, got, err, tc.want, tc.err)
+		}
+	}
+}
+
+// testArchive returns a ZIP archive holding the given files,
+// which are compressed.
+func testArchive(t *testing.T, files map[string][]byte) *zip.Reader {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for name, data := range files {
+		w, err := zw.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write(data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return zr
+}
+
+func TestImportEntries(t *testing.T) {
+	zr := testArchive(t, map[string][]byte{
+		"photo.jpg":                  []byte("a"),
+		"holiday/beach.jpg":          []byte("b"),
+		"holiday/":                   nil,
+		"__MACOSX/holiday/beach.jpg": []byte("c"),
+		"holiday/._beach.jpg":        []byte("d"),
+		".DS_Store":                  []byte("e"),
+	})
+	var got []string
+	for _, zf := range importEntries(zr) {
+		got = append(got, zf.Name)
+	}
+	want := map[string]bool{"photo.jpg": true, "holiday/beach.jpg": true}
+	if len(got) != len(want) {
+		t.Fatalf("importEntries() = %v, want photo.jpg and holiday/beach.jpg", got)
+	}
+	for _, name := range got {
+		if !want[name] {
+			t.Errorf("importEntries() includes %q", name)
+		}
+	}
+}
+
+// TestImportEntryLimits checks the entries that are refused
+// before any of their data is handed to the ImageService, which
+// is why there is none.
+func TestImportEntryLimits(t *testing.T) {
+	zeros := make([]byte, 1<<20)
+	// Random data doesn't compress, like a photo.
+	noise := make([]byte, 16<<10)
+	rand.New(rand.NewSource(1)).Read(noise)
+	zr := testArchive(t, map[string][]byte{
+		"bomb.jpg":      zeros,
+		"../escape.jpg": []byte("x"),
+		"large.jpg":     noise,
+	})
+	tests := []struct {
+		name   string
+		budget int64
+		want   error
+	}{
+		{"bomb.jpg", maxImportBytes, models.ErrImportRatio},
+		{"../escape.jpg", maxImportBytes, models.ErrImportPath},
+		{"large.jpg", 1 << 10, models.ErrImportTooLarge},
+	}
+	for _, tc := range tests {
+		var zf *zip.File
+		for _, f := range zr.File {
+			if f.Name == tc.name {
+				zf = f
+			}
+		}
+		budget := &importBudget{remaining: tc.budget}
+		_, err := importEntry(nil, zf, budget, models.Image{})
+		if err != tc.want {
+			t.Errorf("importEntry(%q) = %v, want %v", tc.name, err, tc.want)
+		}
+		if budget.remaining != tc.budget {
+			t.Errorf("importEntry(%q) used %d bytes of the budget",
+				tc.name, tc.budget-budget.remaining)
+		}
+	}
+}
+
+func TestImportBudget(t *testing.T) {
+	tests := []struct {
+		name   string
+		data   string
+		budget int64
+		want   error
+	}{
+		{"under", "hello", 10, nil},
+		{"exactly", "hello", 5, nil},
+		{"over", "hello world", 5, models.ErrImportTooLarge},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			budget := &importBudget{remaining: tc.budget}
+			_, err := ioutil.ReadAll(budget.reader(strings.NewReader(tc.data)))
+			if err != tc.want {
+				t.Errorf("ReadAll() = %v, want %v", err, tc.want)
+			}
+		})
+	}
+	// The budget is shared by every entry of an archive.
+	budget := &importBudget{remaining: 8}
+	ioutil.ReadAll(budget.reader(strings.NewReader("hello")))
+	_, err := ioutil.ReadAll(budget.reader(strings.NewReader("hello")))
+	if err != models.ErrImportTooLarge {
+		t.Errorf("ReadAll() of the second entry = %v, want %v", err, models.ErrImportTooLarge)
+	}
+}
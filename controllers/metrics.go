@@ -0,0 +1,76 @@
+package controllers
+
+import (
+	"expvar"
+	"net/http"
+	"time"
+
+	"github.com/yakushou730/golang-web-course/models"
+)
+
+// imageMetrics counts the requests served by Images.Show. The
+// counters are published with expvar under "images", so they
+// can be read from the /debug/vars handler.
+var imageMetrics = newServeMetrics("images")
+
+// serveMetrics keeps running totals for a handler serving
+// files. Dividing duration_ns by requests gives the average
+// time spent per request.
+type serveMetrics struct {
+	vars *expvar.Map
+}
+
+func newServeMetrics(name string) *serveMetrics {
+	return &serveMetrics{
+		vars: expvar.NewMap(name),
+	}
+}
+
+// record adds a finished request for the named variant, or the
+// original when variant is empty, to the totals. The variant
+// comes from the URL, so anything we don't serve is counted as
+// "other" rather than getting a counter of its own.
+func (sm *serveMetrics) record(variant string, status int, bytes int64, d time.Duration) {
+	switch variant {
+	case "":
+		variant = "original"
+	case models.ThumbVariant, models.DisplayVariant:
+	default:
+		variant = "other"
+	}
+	sm.vars.Add("requests", 1)
+	sm.vars.Add("requests_"+variant, 1)
+	sm.vars.Add("bytes", bytes)
+	sm.vars.Add("duration_ns", int64(d))
+	switch {
+	case status == http.StatusNotModified:
+		sm.vars.Add("not_modified", 1)
+	case status == http.StatusPartialContent:
+		sm.vars.Add("partial", 1)
+	case status >= 300 && status < 400:
+		sm.vars.Add("redirects", 1)
+	case status >= 500:
+		sm.vars.Add("errors", 1)
+	case status >= 400:
+		sm.vars.Add("rejected", 1)
+	}
+}
+
+// metricsWriter remembers the status and the number of body
+// bytes written to a response.
+type metricsWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (mw *metricsWriter) WriteHeader(status int) {
+	mw.status = status
+	mw.ResponseWriter.WriteHeader(status)
+}
+
+func (mw *metricsWriter) Write(b []byte) (int, error) {
+	n, err := mw.ResponseWriter.Write(b)
+	mw.bytes += int64(n)
+	return n, err
+}
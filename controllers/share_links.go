@@ -0,0 +1,288 @@
+package controllers
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"github.com/yakushou730/golang-web-course/context"
+	"github.com/yakushou730/golang-web-course/models"
+	"github.com/yakushou730/golang-web-course/views"
+)
+
+// shareCookiePrefix starts the name of every cookie that
+// remembers a visitor opened a share link. There is one per
+// link so opening a second link doesn't forget the first.
+const shareCookiePrefix = "share_"
+
+// maxShareCookies is how many share cookies sharedWith looks at
+// before giving up. Visitors won't have opened more links than
+// that, so anything over it is somebody trying to slow us down.
+const maxShareCookies = 20
+
+// ShareLinkForm is used to create a share link. ExpiresDays is
+// how many days the link works for and MaxViews how many times
+// it can be opened, with 0 meaning no limit for both.
+type ShareLinkForm struct {
+	Label       string `schema:"label"`
+	Password    string `schema:"password"`
+	ExpiresDays int    `schema:"expires_days"`
+	MaxViews    int    `schema:"max_views"`
+}
+
+// SharePasswordForm holds the password a visitor entered to
+// open a share link.
+type SharePasswordForm struct {
+	Password string `schema:"password"`
+}
+
+// POST /galleries/:id/shares
+func (g *Galleries) ShareLinkCreate(w http.ResponseWriter, r *http.Request) {
+	gallery, ok := g.ownGallery(w, r)
+	if !ok {
+		return
+	}
+	var vd views.Data
+	vd.Yield = gallery
+	var form ShareLinkForm
+	if err := parseForm(r, &form); err != nil {
+		vd.SetAlert(err)
+		g.renderEdit(w, r, vd)
+		return
+	}
+	if form.ExpiresDays < 0 {
+		vd.AlertError("Share links must expire in the future.")
+		g.renderEdit(w, r, vd)
+		return
+	}
+	link := models.ShareLink{
+		GalleryID: gallery.ID,
+		Label:     form.Label,
+		Password:  form.Password,
+		MaxViews:  form.MaxViews,
+	}
+	if form.ExpiresDays > 0 {
+		expires := time.Now().Add(time.Duration(form.ExpiresDays) * 24 * time.Hour)
+		link.ExpiresAt = &expires
+	}
+	if err := g.ss.Create(&link); err != nil {
+		vd.SetAlert(err)
+		g.renderEdit(w, r, vd)
+		return
+	}
+	data := g.editData(gallery)
+	data.NewShareLink = shareURL(r, link.Token)
+	vd.Yield = data
+	vd.Alert = &views.Alert{
+		Level: views.AlertLvlSuccess,
+		Message: "Share link created! Copy it now, it can't be " +
+			"shown again.",
+	}
+	g.EditView.Render(w, r, vd)
+}
+
+// POST /galleries/:id/shares/:shareID/revoke
+func (g *Galleries) ShareLinkRevoke(w http.ResponseWriter, r *http.Request) {
+	gallery, ok := g.ownGallery(w, r)
+	if !ok {
+		return
+	}
+	var vd views.Data
+	vd.Yield = gallery
+	id, err := strconv.Atoi(mux.Vars(r)["shareID"])
+	if err != nil {
+		http.Error(w, "Invalid share link ID", http.StatusNotFound)
+		return
+	}
+	link, err := g.ss.ByID(uint(id))
+	if err == nil && link.GalleryID != gallery.ID {
+		err = models.ErrNotFound
+	}
+	if err == nil {
+		err = g.ss.Revoke(link.ID)
+	}
+	if err != nil {
+		vd.SetAlert(err)
+		g.renderEdit(w, r, vd)
+		return
+	}
+	vd.Alert = &views.Alert{
+		Level:   views.AlertLvlSuccess,
+		Message: "Share link revoked.",
+	}
+	g.renderEdit(w, r, vd)
+}
+
+// GET /s/:token
+//
+// ShareShow opens a share link. Visitors who opened it before
+// go straight to the gallery, everybody else is asked for the
+// password first if the link has one.
+func (g *Galleries) ShareShow(w http.ResponseWriter, r *http.Request) {
+	link, ok := g.shareLink(w, r)
+	if !ok {
+		return
+	}
+	if g.granted(r, link) {
+		g.redirectToShared(w, r, link)
+		return
+	}
+	var vd views.Data
+	vd.Yield = mux.Vars(r)["token"]
+	if err := link.Check(); err != nil {
+		vd.SetAlert(err)
+		vd.Yield = nil
+		g.ShareView.Render(w, r, vd)
+		return
+	}
+	if link.HasPassword() {
+		g.ShareView.Render(w, r, vd)
+		return
+	}
+	g.grant(w, r, link, vd)
+}
+
+// POST /s/:token
+func (g *Galleries) ShareUnlock(w http.ResponseWriter, r *http.Request) {
+	link, ok := g.shareLink(w, r)
+	if !ok {
+		return
+	}
+	var vd views.Data
+	vd.Yield = mux.Vars(r)["token"]
+	if err := link.Check(); err != nil {
+		vd.SetAlert(err)
+		vd.Yield = nil
+		g.ShareView.Render(w, r, vd)
+		return
+	}
+	var form SharePasswordForm
+	if err := parseForm(r, &form); err != nil {
+		vd.SetAlert(err)
+		g.ShareView.Render(w, r, vd)
+		return
+	}
+	if err := g.ss.Unlock(link, form.Password); err != nil {
+		vd.SetAlert(err)
+		g.ShareView.Render(w, r, vd)
+		return
+	}
+	g.grant(w, r, link, vd)
+}
+
+// grant counts a view of the link and remembers the visitor
+// opened it, then sends them to the gallery. vd is rendered
+// with an error if the link has no views left.
+func (g *Galleries) grant(w http.ResponseWriter, r *http.Request, link *models.ShareLink, vd views.Data) {
+	if err := g.ss.AddView(link); err != nil {
+		vd.SetAlert(err)
+		vd.Yield = nil
+		g.ShareView.Render(w, r, vd)
+		return
+	}
+	until := time.Now().Add(models.ShareGrantTTL)
+	if link.ExpiresAt != nil && link.ExpiresAt.Before(until) {
+		until = *link.ExpiresAt
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     fmt.Sprintf("%s%d", shareCookiePrefix, link.ID),
+		Value:    g.ss.Grant(link, until),
+		Path:     "/",
+		Expires:  until,
+		HttpOnly: true,
+		Secure:   g.isProd,
+	})
+	g.redirectToShared(w, r, link)
+}
+
+// redirectToShared sends the visitor to the gallery of the link
+// by ID, even if it is unlisted, so that seeing it keeps
+// depending on the link rather than on the slug, which works
+// for as long as the gallery stays unlisted.
+func (g *Galleries) redirectToShared(w http.ResponseWriter, r *http.Request, link *models.ShareLink) {
+	http.Redirect(w, r, fmt.Sprintf("/galleries/%d", link.GalleryID), http.StatusFound)
+}
+
+// granted reports whether the visitor opened the link before.
+func (g *Galleries) granted(r *http.Request, link *models.ShareLink) bool {
+	c, err := r.Cookie(fmt.Sprintf("%s%d", shareCookiePrefix, link.ID))
+	if err != nil {
+		return false
+	}
+	granted, err := g.ss.ByGrant(c.Value)
+	return err == nil && granted.ID == link.ID
+}
+
+// sharedWith reports whether the visitor opened a share link of
+// the gallery that still works. This runs for every image, so
+// grants are checked in memory first and only the ones for the
+// gallery are looked up, and at most maxShareCookies cookies
+// are looked at.
+func sharedWith(r *http.Request, ss models.ShareLinkService, galleryID uint) bool {
+	checked := 0
+	for _, c := range r.Cookies() {
+		if !strings.HasPrefix(c.Name, shareCookiePrefix) {
+			continue
+		}
+		if checked++; checked > maxShareCookies {
+			return false
+		}
+		id, err := strconv.ParseUint(strings.TrimPrefix(c.Name, shareCookiePrefix), 10, 64)
+		if err != nil {
+			continue
+		}
+		linkID, grantGalleryID, err := ss.CheckGrant(c.Value)
+		if err != nil || linkID != uint(id) || grantGalleryID != galleryID {
+			continue
+		}
+		if _, err := ss.ByGrant(c.Value); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// shareLink looks up the share link with the token in the URL,
+// rendering an error if there is none.
+func (g *Galleries) shareLink(w http.ResponseWriter, r *http.Request) (*models.ShareLink, bool) {
+	link, err := g.ss.ByToken(mux.Vars(r)["token"])
+	if err != nil {
+		if err != models.ErrNotFound {
+			log.Println(err)
+		}
+		http.Error(w, "Share link not found", http.StatusNotFound)
+		return nil, false
+	}
+	return link, true
+}
+
+// ownGallery looks up the gallery with the ID in the URL and
+// makes sure it belongs to the current user.
+func (g *Galleries) ownGallery(w http.ResponseWriter, r *http.Request) (*models.Gallery, bool) {
+	gallery, err := g.galleryById(w, r)
+	if err != nil {
+		return nil, false
+	}
+	user := context.User(r.Context())
+	if gallery.UserID != user.ID {
+		http.Error(w, "You do not have permission to edit "+
+			"this gallery", http.StatusForbidden)
+		return nil, false
+	}
+	return gallery, true
+}
+
+// shareURL returns the full URL of a share link, for the owner
+// to send to someone.
+func shareURL(r *http.Request, token string) string {
+	scheme := "http"
+	if r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https" {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host + "/s/" + token
+}
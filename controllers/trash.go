@@ -0,0 +1,245 @@
+package controllers
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"github.com/yakushou730/golang-web-course/context"
+	"github.com/yakushou730/golang-web-course/models"
+	"github.com/yakushou730/golang-web-course/views"
+)
+
+// Trash lets users see the galleries and images they deleted,
+// and either restore them or delete them for good. Anything
+// left in the trash is purged once the retention period is up.
+type Trash struct {
+	IndexView *views.View
+	gs        models.GalleryService
+	is        models.ImageService
+	retention time.Duration
+}
+
+// trashItem is a gallery or image in the trash. Kind is either
+// "galleries" or "images", as used in the trash URLs, Gallery
+// is the title of the gallery an image belongs to, and PurgeAt
+// is zero if the item is kept until it is purged by hand.
+type trashItem struct {
+	Kind      string
+	ID        uint
+	Name      string
+	Gallery   string
+	DeletedAt time.Time
+	PurgeAt   time.Time
+}
+
+// NewTrash returns the controller for the trash page. Items
+// are purged retention after they were deleted, or never if
+// retention is 0.
+func NewTrash(gs models.GalleryService, is models.ImageService, retention time.Duration) *Trash {
+	return &Trash{
+		IndexView: views.NewView("bootstrap", "trash/index"),
+		gs:        gs,
+		is:        is,
+		retention: retention,
+	}
+}
+
+// GET /trash
+func (t *Trash) Index(w http.ResponseWriter, r *http.Request) {
+	var vd views.Data
+	t.render(w, r, vd)
+}
+
+// POST /trash/galleries/:id/restore
+func (t *Trash) GalleryRestore(w http.ResponseWriter, r *http.Request) {
+	gallery, ok := t.gallery(w, r)
+	if !ok {
+		return
+	}
+	if err := t.gs.Restore(gallery.ID); err != nil {
+		var vd views.Data
+		vd.SetAlert(err)
+		t.render(w, r, vd)
+		return
+	}
+	t.redirect(w, r, "Gallery \""+gallery.Title+"\" restored.")
+}
+
+// POST /trash/galleries/:id/delete
+func (t *Trash) GalleryDelete(w http.ResponseWriter, r *http.Request) {
+	gallery, ok := t.gallery(w, r)
+	if !ok {
+		return
+	}
+	// This is what Services.PurgeGallery does: the images go
+	// first so a failure part way through can be retried.
+	err := t.is.DeleteByGalleryID(gallery.ID)
+	if err == nil {
+		err = t.gs.Purge(gallery.ID)
+	}
+	if err != nil {
+		var vd views.Data
+		vd.SetAlert(err)
+		t.render(w, r, vd)
+		return
+	}
+	t.redirect(w, r, "Gallery \""+gallery.Title+"\" deleted for good.")
+}
+
+// POST /trash/images/:id/restore
+func (t *Trash) ImageRestore(w http.ResponseWriter, r *http.Request) {
+	image, ok := t.image(w, r)
+	if !ok {
+		return
+	}
+	var vd views.Data
+	// An image can't go back into a gallery that is itself in
+	// the trash.
+	if _, err := t.gs.ByID(image.GalleryID); err != nil {
+		if err == models.ErrNotFound {
+			vd.AlertError("Restore the gallery this image " +
+				"belongs to first.")
+		} else {
+			vd.SetAlert(err)
+		}
+		t.render(w, r, vd)
+		return
+	}
+	if err := t.is.Restore(image); err != nil {
+		vd.SetAlert(err)
+		t.render(w, r, vd)
+		return
+	}
+	t.redirect(w, r, "Image \""+image.Filename+"\" restored.")
+}
+
+// POST /trash/images/:id/delete
+func (t *Trash) ImageDelete(w http.ResponseWriter, r *http.Request) {
+	image, ok := t.image(w, r)
+	if !ok {
+		return
+	}
+	if err := t.is.Purge(image); err != nil {
+		var vd views.Data
+		vd.SetAlert(err)
+		t.render(w, r, vd)
+		return
+	}
+	t.redirect(w, r, "Image \""+image.Filename+"\" deleted for good.")
+}
+
+// render renders the trash page with everything the current
+// user has in the trash.
+func (t *Trash) render(w http.ResponseWriter, r *http.Request, vd views.Data) {
+	user := context.User(r.Context())
+	galleries, err := t.gs.Deleted(user.ID)
+	if err != nil {
+		vd.SetAlert(err)
+	}
+	images, err := t.is.Deleted(user.ID)
+	if err != nil {
+		vd.SetAlert(err)
+	}
+	titles := make(map[uint]string)
+	if live, err := t.gs.ByUserID(user.ID); err == nil {
+		for _, g := range live {
+			titles[g.ID] = g.Title
+		}
+	}
+	var yield struct {
+		Galleries []trashItem
+		Images    []trashItem
+	}
+	for _, g := range galleries {
+		titles[g.ID] = g.Title
+		yield.Galleries = append(yield.Galleries,
+			t.item("galleries", g.ID, g.Title, "", g.DeletedAt))
+	}
+	for _, i := range images {
+		yield.Images = append(yield.Images,
+			t.item("images", i.ID, i.Filename, titles[i.GalleryID], i.DeletedAt))
+	}
+	vd.Yield = yield
+	t.IndexView.Render(w, r, vd)
+}
+
+func (t *Trash) item(kind string, id uint, name, gallery string, deletedAt *time.Time) trashItem {
+	item := trashItem{
+		Kind:    kind,
+		ID:      id,
+		Name:    name,
+		Gallery: gallery,
+	}
+	if deletedAt != nil {
+		item.DeletedAt = *deletedAt
+		if t.retention > 0 {
+			item.PurgeAt = deletedAt.Add(t.retention)
+		}
+	}
+	return item
+}
+
+func (t *Trash) redirect(w http.ResponseWriter, r *http.Request, msg string) {
+	views.RedirectAlert(w, r, "/trash", http.StatusFound, views.Alert{
+		Level:   views.AlertLvlSuccess,
+		Message: msg,
+	})
+}
+
+// gallery looks up the gallery in the trash with the ID in the
+// URL, making sure it belongs to the current user.
+func (t *Trash) gallery(w http.ResponseWriter, r *http.Request) (*models.Gallery, bool) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid gallery ID", http.StatusNotFound)
+		return nil, false
+	}
+	gallery, err := t.gs.DeletedByID(uint(id))
+	if err != nil {
+		t.notFound(w, r, err)
+		return nil, false
+	}
+	user := context.User(r.Context())
+	if gallery.UserID != user.ID {
+		http.Error(w, "Gallery not found", http.StatusNotFound)
+		return nil, false
+	}
+	return gallery, true
+}
+
+// image looks up the image in the trash with the ID in the URL,
+// making sure it belongs to the current user.
+func (t *Trash) image(w http.ResponseWriter, r *http.Request) (*models.Image, bool) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid image ID", http.StatusNotFound)
+		return nil, false
+	}
+	image, err := t.is.DeletedByID(uint(id))
+	if err != nil {
+		t.notFound(w, r, err)
+		return nil, false
+	}
+	user := context.User(r.Context())
+	if image.UserID != user.ID {
+		http.Error(w, "Image not found", http.StatusNotFound)
+		return nil, false
+	}
+	return image, true
+}
+
+// notFound handles a failed lookup. The item was most likely
+// restored or purged already, so we show the trash as it is
+// now.
+func (t *Trash) notFound(w http.ResponseWriter, r *http.Request, err error) {
+	var vd views.Data
+	if err == models.ErrNotFound {
+		vd.AlertError("That is no longer in the trash.")
+	} else {
+		vd.SetAlert(err)
+	}
+	t.render(w, r, vd)
+}
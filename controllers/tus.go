@@ -0,0 +1,296 @@
+package controllers
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+
+	"github.com/yakushou730/golang-web-course/context"
+	"github.com/yakushou730/golang-web-course/models"
+	"github.com/yakushou730/golang-web-course/views"
+)
+
+const (
+	tusVersion    = "1.0.0"
+	tusExtensions = "creation,termination,expiration"
+)
+
+// Uploads implements the tus resumable upload protocol
+// (https://tus.io/protocols/resumable-upload.html) for adding
+// images to a gallery. Large uploads are sent in pieces, and
+// an interrupted upload can carry on from the last piece that
+// made it to the server instead of starting over.
+//
+// Like every other request that changes something, tus
+// requests need the CSRF token in the X-CSRF-Token header.
+type Uploads struct {
+	gs      models.GalleryService
+	is      models.ImageService
+	store   *models.UploadStore
+	maxSize int64
+}
+
+// NewUploads returns the controller for resumable uploads.
+// Uploads larger than maxSize are refused before any of their
+// data is sent.
+func NewUploads(gs models.GalleryService, is models.ImageService,
+	store *models.UploadStore, maxSize int64) *Uploads {
+	return &Uploads{
+		gs:      gs,
+		is:      is,
+		store:   store,
+		maxSize: maxSize,
+	}
+}
+
+// OPTIONS /galleries/:id/uploads
+func (u *Uploads) Options(w http.ResponseWriter, r *http.Request) {
+	h := w.Header()
+	h.Set("Tus-Resumable", tusVersion)
+	h.Set("Tus-Version", tusVersion)
+	h.Set("Tus-Extension", tusExtensions)
+	h.Set("Tus-Max-Size", strconv.FormatInt(u.maxSize, 10))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// POST /galleries/:id/uploads
+//
+// Create starts an upload. The size of the file goes in the
+// Upload-Length header and its name in the filename key of
+// the Upload-Metadata header.
+func (u *Uploads) Create(w http.ResponseWriter, r *http.Request) {
+	gallery, ok := u.gallery(w, r)
+	if !ok {
+		return
+	}
+	length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || length < 0 {
+		http.Error(w, "Upload-Length is not valid.", http.StatusBadRequest)
+		return
+	}
+	if length > u.maxSize {
+		http.Error(w, models.ErrImageTooLarge.Public()+".",
+			http.StatusRequestEntityTooLarge)
+		return
+	}
+	filename := parseTusMetadata(r.Header.Get("Upload-Metadata"))["filename"]
+	if filename == "" {
+		http.Error(w, models.ErrFilenameRequired.Public()+".", http.StatusBadRequest)
+		return
+	}
+	// There is no point accepting gigabytes of data just to
+	// refuse it at the end.
+	user := context.User(r.Context())
+	if usage, err := u.is.Usage(user.ID); err == nil &&
+		!usage.Unlimited() && usage.Used+length > usage.Quota {
+		http.Error(w, models.ErrStorageQuotaExceeded.Public()+".",
+			http.StatusRequestEntityTooLarge)
+		return
+	}
+	upload := models.Upload{
+		GalleryID: gallery.ID,
+		UserID:    user.ID,
+		Filename:  filename,
+		Length:    length,
+	}
+	if err := u.store.Create(&upload); err != nil {
+		u.renderError(w, err)
+		return
+	}
+	w.Header().Set("Location", u.uploadPath(&upload))
+	w.Header().Set("Upload-Expires", u.store.Expires(&upload).UTC().Format(http.TimeFormat))
+	w.WriteHeader(http.StatusCreated)
+}
+
+// HEAD /galleries/:id/uploads/:uploadID
+//
+// Head tells the client how much of the upload we have, so it
+// knows where to resume from.
+func (u *Uploads) Head(w http.ResponseWriter, r *http.Request) {
+	upload, _, ok := u.upload(w, r)
+	if !ok {
+		return
+	}
+	h := w.Header()
+	h.Set("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+	h.Set("Upload-Length", strconv.FormatInt(upload.Length, 10))
+	h.Set("Upload-Expires", u.store.Expires(upload).UTC().Format(http.TimeFormat))
+	h.Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+}
+
+// PATCH /galleries/:id/uploads/:uploadID
+//
+// Patch appends a piece of the upload, which must start at the
+// offset given in the Upload-Offset header. Once the whole
+// file has arrived it is created as an image in the gallery.
+func (u *Uploads) Patch(w http.ResponseWriter, r *http.Request) {
+	upload, gallery, ok := u.upload(w, r)
+	if !ok {
+		return
+	}
+	if r.Header.Get("Content-Type") != "application/offset+octet-stream" {
+		http.Error(w, "Content-Type must be application/offset+octet-stream.",
+			http.StatusUnsupportedMediaType)
+		return
+	}
+	offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil || offset < 0 {
+		http.Error(w, "Upload-Offset is not valid.", http.StatusBadRequest)
+		return
+	}
+	err = u.store.Append(upload, offset, r.Body)
+	w.Header().Set("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+	switch err {
+	case nil:
+	case models.ErrUploadOffset:
+		u.renderError(w, err)
+		return
+	default:
+		if !upload.Done() {
+			// Most likely the connection dropped. The client can
+			// ask where we got to and carry on from there.
+			u.renderError(w, err)
+			return
+		}
+	}
+	if upload.Done() {
+		if err := u.finish(upload, gallery); err != nil {
+			u.renderError(w, err)
+			return
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// DELETE /galleries/:id/uploads/:uploadID
+func (u *Uploads) Delete(w http.ResponseWriter, r *http.Request) {
+	upload, _, ok := u.upload(w, r)
+	if !ok {
+		return
+	}
+	if err := u.store.Delete(upload); err != nil {
+		u.renderError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// finish hands a completed upload to the ImageService. The
+// UploadStore makes sure this happens once, even if the last
+// piece of the upload is sent twice.
+func (u *Uploads) finish(upload *models.Upload, gallery *models.Gallery) error {
+	return u.store.Finish(upload, func(r io.Reader) error {
+		image := models.Image{
+			GalleryID: gallery.ID,
+			UserID:    upload.UserID,
+			Filename:  upload.Filename,
+			KeepGPS:   gallery.KeepGPS,
+		}
+		return u.is.Create(&image, r)
+	})
+}
+
+// gallery looks up the gallery in the URL and makes sure it
+// belongs to the current user. It also checks the request is
+// using a version of tus we speak. If anything is wrong the
+// error is rendered and ok is false.
+func (u *Uploads) gallery(w http.ResponseWriter, r *http.Request) (*models.Gallery, bool) {
+	w.Header().Set("Tus-Resumable", tusVersion)
+	if r.Header.Get("Tus-Resumable") != tusVersion {
+		w.Header().Set("Tus-Version", tusVersion)
+		http.Error(w, "Unsupported tus version.", http.StatusPreconditionFailed)
+		return nil, false
+	}
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.NotFound(w, r)
+		return nil, false
+	}
+	gallery, err := u.gs.ByID(uint(id))
+	if err != nil {
+		u.renderError(w, err)
+		return nil, false
+	}
+	user := context.User(r.Context())
+	if gallery.UserID != user.ID {
+		http.NotFound(w, r)
+		return nil, false
+	}
+	return gallery, true
+}
+
+// upload looks up the upload in the URL, making sure it was
+// started by the current user for the gallery in the URL.
+func (u *Uploads) upload(w http.ResponseWriter, r *http.Request) (*models.Upload, *models.Gallery, bool) {
+	gallery, ok := u.gallery(w, r)
+	if !ok {
+		return nil, nil, false
+	}
+	upload, err := u.store.ByID(mux.Vars(r)["uploadID"])
+	if err != nil {
+		u.renderError(w, err)
+		return nil, nil, false
+	}
+	if upload.GalleryID != gallery.ID || upload.UserID != gallery.UserID {
+		http.NotFound(w, r)
+		return nil, nil, false
+	}
+	return upload, gallery, true
+}
+
+func (u *Uploads) uploadPath(upload *models.Upload) string {
+	return fmt.Sprintf("/galleries/%d/uploads/%s", upload.GalleryID, upload.ID)
+}
+
+func (u *Uploads) renderError(w http.ResponseWriter, err error) {
+	switch err {
+	case models.ErrNotFound:
+		http.Error(w, "Gallery or upload not found.", http.StatusNotFound)
+	case models.ErrUploadExpired:
+		http.Error(w, err.(views.PublicError).Public()+".", http.StatusGone)
+	case models.ErrUploadOffset:
+		http.Error(w, err.(views.PublicError).Public()+".", http.StatusConflict)
+	case models.ErrUploadBusy:
+		http.Error(w, err.(views.PublicError).Public()+".", http.StatusLocked)
+	case models.ErrUploadTooLarge, models.ErrImageTooLarge, models.ErrStorageQuotaExceeded:
+		http.Error(w, err.(views.PublicError).Public()+".", http.StatusRequestEntityTooLarge)
+	default:
+		if pErr, ok := err.(views.PublicError); ok {
+			// Most likely the image didn't pass validation.
+			http.Error(w, pErr.Public()+".", http.StatusUnprocessableEntity)
+			return
+		}
+		log.Println(err)
+		http.Error(w, "Whoops! Something went wrong.", http.StatusInternalServerError)
+	}
+}
+
+// parseTusMetadata decodes an Upload-Metadata header, which is
+// a comma separated list of keys each followed by a space and
+// its base64 encoded value.
+func parseTusMetadata(header string) map[string]string {
+	md := make(map[string]string)
+	for _, pair := range strings.Split(header, ",") {
+		parts := strings.SplitN(strings.TrimSpace(pair), " ", 2)
+		if parts[0] == "" {
+			continue
+		}
+		var value string
+		if len(parts) == 2 {
+			b, err := base64.StdEncoding.DecodeString(parts[1])
+			if err != nil {
+				continue
+			}
+			value = string(b)
+		}
+		md[parts[0]] = value
+	}
+	return md
+}
@@ -0,0 +1,46 @@
+package controllers
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/yakushou730/golang-web-course/views"
+)
+
+// uploadError is the error returned while storing a single
+// file from a multi-file upload.
+type uploadError struct {
+	Filename string
+	Err      error
+}
+
+// uploadErrors collects the errors for every file that failed
+// in a multi-file upload. It implements views.PublicError so
+// that a single alert can tell the user which files failed
+// and why.
+type uploadErrors []uploadError
+
+func (ue uploadErrors) Error() string {
+	msgs := make([]string, len(ue))
+	for i, e := range ue {
+		msgs[i] = fmt.Sprintf("%s: %v", e.Filename, e.Err)
+	}
+	return strings.Join(msgs, "; ")
+}
+
+func (ue uploadErrors) Public() string {
+	return "Some files could not be uploaded. " + ue.details()
+}
+
+// details lists the files that failed along with the public
+// message for each of their errors.
+func (ue uploadErrors) details() string {
+	msgs := make([]string, len(ue))
+	for i, e := range ue {
+		var vd views.Data
+		vd.SetAlert(e.Err)
+		msg := strings.TrimSuffix(vd.Alert.Message, ".")
+		msgs[i] = fmt.Sprintf("%s: %s.", e.Filename, msg)
+	}
+	return strings.Join(msgs, " ")
+}
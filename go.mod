@@ -9,6 +9,8 @@ require (
 	github.com/jinzhu/gorm v1.9.11
 	github.com/julienschmidt/httprouter v1.3.0
 	github.com/lib/pq v1.2.0
-	golang.org/x/crypto v0.0.0-20190325154230-a5d413f7728c
+	github.com/minio/minio-go/v6 v6.0.44
+	golang.org/x/crypto v0.0.0-20190513172903-22d7a77e9e5f
+	golang.org/x/image v0.0.0-20190910094157-69e4b8554b2a
 	gopkg.in/mailgun/mailgun-go.v1 v1.1.1
 )
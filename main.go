@@ -1,9 +1,11 @@
 package main
 
 import (
+	"expvar"
 	"flag"
 	"fmt"
 	"net/http"
+	"time"
 
 	"github.com/yakushou730/golang-web-course/email"
 
@@ -23,12 +25,31 @@ func main() {
 	boolPtr := flag.Bool("prod", false, "Provide this flag "+
 		"in production. This ensures that a .config file is "+
 		"provided before the application starts.")
+	sweepPtr := flag.Bool("sweep", false, "Report image files "+
+		"and records that nothing refers to any more, then exit.")
+	sweepDeletePtr := flag.Bool("sweep-delete", false, "Like "+
+		"-sweep, but also delete what was found.")
+	purgePtr := flag.Duration("purge-deleted", 0, "With -sweep or "+
+		"-sweep-delete, first purge the galleries and images that "+
+		"were moved to the trash longer ago than this, eg 720h.")
 	flag.Parse()
 	// boolPtr is a pointer to a boolean, so we need to use
 	// *boolPtr to get the boolean value and pass it into our
 	// LoadConfig function
 	cfg := LoadConfig(*boolPtr)
 	dbCfg := cfg.Database
+	store, err := cfg.Storage.Storage()
+	if err != nil {
+		panic(err)
+	}
+	resizeCache, err := cfg.Images.Resize.Cache()
+	if err != nil {
+		panic(err)
+	}
+	uploadStore, err := cfg.Uploads.Store()
+	if err != nil {
+		panic(err)
+	}
 	// This isn't complete, but we will come back to it shortly
 	services, err := models.NewServices(
 		models.WithGorm(dbCfg.Dialect(), dbCfg.ConnectionInfo()),
@@ -37,13 +58,49 @@ func main() {
 		// one of them we could possibly skip that config func
 		models.WithUser(cfg.Pepper, cfg.HMACKey),
 		models.WithGallery(),
-		models.WithImage(),
+		models.WithJobs(),
+		models.WithShareLinks(cfg.Pepper, cfg.HMACKey),
+		models.WithImage(models.ImageConfig{
+			Storage:      store,
+			Variants:     cfg.Images.Variants(),
+			MaxBytes:     cfg.Images.MaxBytes,
+			MaxWidth:     cfg.Images.MaxWidth,
+			MaxHeight:    cfg.Images.MaxHeight,
+			Collision:    models.CollisionPolicy(cfg.Images.Collision),
+			Signer:       cfg.Images.URLSigner(cfg.HMACKey),
+			ResizeSizes:  cfg.Images.Resize.Sizes,
+			ResizeCache:  resizeCache,
+			DefaultQuota: cfg.Images.DefaultQuota,
+		}),
 	)
 	if err != nil {
 		panic(err)
 	}
 	defer services.Close()
 	services.AutoMigrate()
+	for userID, quota := range cfg.Images.Quotas {
+		if err := services.Image.SetQuota(userID, quota); err != nil {
+			panic(err)
+		}
+	}
+	if *sweepPtr || *sweepDeletePtr {
+		if err := sweep(services, *purgePtr, *sweepDeletePtr); err != nil {
+			panic(err)
+		}
+		return
+	}
+
+	// Image processing and other slow work happens in the
+	// background, outside of any request.
+	workers := models.NewWorkerPool(services.Job, cfg.Jobs.Workers)
+	workers.Handle(models.JobImageVariants, services.Image.ProcessVariants)
+	workers.Start()
+	defer workers.Stop()
+
+	if retention := cfg.Trash.Retention(); retention > 0 {
+		go purgeTrash(services, retention, time.Hour)
+	}
+	go removeExpiredUploads(uploadStore, time.Hour)
 
 	mgCfg := cfg.Mailgun
 	emailer := email.NewClient(
@@ -54,7 +111,8 @@ func main() {
 	r := mux.NewRouter()
 	staticC := controllers.NewStatic()
 	usersC := controllers.NewUsers(services.User, emailer)
-	galleriesC := controllers.NewGalleries(services.Gallery, services.Image, r)
+	galleriesC := controllers.NewGalleries(services.Gallery, services.Image,
+		services.Job, services.ShareLink, r, cfg.IsProd())
 
 	userMw := middleware.User{
 		UserService: services.User,
@@ -68,8 +126,17 @@ func main() {
 	createGallery := requireUserMw.ApplyFn(galleriesC.Create)
 
 	// Image routes
-	imageHandler := http.FileServer(http.Dir("./images/"))
-	r.PathPrefix("/images/").Handler(http.StripPrefix("/images/", imageHandler))
+	imagesC := controllers.NewImages(services.Image, services.Gallery,
+		services.ShareLink)
+	r.HandleFunc("/images/galleries/{id:[0-9]+}/{filename}",
+		imagesC.Show).Methods("GET")
+	r.HandleFunc("/images/{variant:[a-z]+}/galleries/{id:[0-9]+}/{filename}",
+		imagesC.Show).Methods("GET")
+	// Counters for the image handler, among others. They include
+	// the command line and memory stats, so they are only shown
+	// to signed in users.
+	r.Handle("/debug/vars",
+		requireUserMw.Apply(expvar.Handler())).Methods("GET")
 	// Assets
 	assetHandler := http.FileServer(http.Dir("./assets/"))
 	assetHandler = http.StripPrefix("/assets/", assetHandler)
@@ -86,12 +153,16 @@ func main() {
 	r.HandleFunc("/galleries", createGallery).Methods("POST")
 	r.HandleFunc("/galleries/{id:[0-9]+}", galleriesC.Show).
 		Methods("GET").Name(controllers.ShowGallery)
+	r.HandleFunc("/galleries/{id:[0-9]+}/images/{imageID:[0-9]+}",
+		galleriesC.ImageShow).Methods("GET")
 	r.HandleFunc("/galleries/{id:[0-9]+}/edit",
 		requireUserMw.ApplyFn(galleriesC.Edit)).
 		Methods("GET").
 		Name(controllers.EditGallery)
 	r.HandleFunc("/galleries/{id:[0-9]+}/update",
 		requireUserMw.ApplyFn(galleriesC.Update)).Methods("POST")
+	r.HandleFunc("/galleries/{id:[0-9]+}/watermark",
+		requireUserMw.ApplyFn(galleriesC.Watermark)).Methods("POST")
 	r.HandleFunc("/galleries/{id:[0-9]+}/delete",
 		requireUserMw.ApplyFn(galleriesC.Delete)).Methods("POST")
 	r.Handle("/galleries",
@@ -101,9 +172,81 @@ func main() {
 	r.HandleFunc("/galleries/{id:[0-9]+}/images",
 		requireUserMw.ApplyFn(galleriesC.ImageUpload)).
 		Methods("POST")
+	r.HandleFunc("/galleries/{id:[0-9]+}/cover",
+		requireUserMw.ApplyFn(galleriesC.Cover)).
+		Methods("POST")
+	r.HandleFunc("/galleries/{id:[0-9]+}/download", galleriesC.Download).
+		Methods("GET")
+	r.HandleFunc("/galleries/{id:[0-9]+}/shares",
+		requireUserMw.ApplyFn(galleriesC.ShareLinkCreate)).Methods("POST")
+	r.HandleFunc("/galleries/{id:[0-9]+}/shares/{shareID:[0-9]+}/revoke",
+		requireUserMw.ApplyFn(galleriesC.ShareLinkRevoke)).Methods("POST")
+	// Share links
+	r.HandleFunc("/s/{token}", galleriesC.ShareShow).Methods("GET")
+	r.HandleFunc("/s/{token}", galleriesC.ShareUnlock).Methods("POST")
+	// Unlisted galleries
+	r.HandleFunc("/g/{slug:[A-Za-z0-9_-]+}", galleriesC.SlugShow).
+		Methods("GET")
+	r.HandleFunc("/g/{slug:[A-Za-z0-9_-]+}/images/{imageID:[0-9]+}",
+		galleriesC.SlugImageShow).Methods("GET")
+	r.HandleFunc("/g/{slug:[A-Za-z0-9_-]+}/download", galleriesC.SlugDownload).
+		Methods("GET")
+	r.HandleFunc("/galleries/search",
+		requireUserMw.ApplyFn(galleriesC.Search)).
+		Methods("GET")
+	r.HandleFunc("/galleries/{id:[0-9]+}/images/{imageID:[0-9]+}/update",
+		requireUserMw.ApplyFn(galleriesC.ImageUpdate)).
+		Methods("POST")
+	r.HandleFunc("/galleries/{id:[0-9]+}/images/import",
+		requireUserMw.ApplyFn(galleriesC.ImageImport)).
+		Methods("POST")
+	// Resumable uploads
+	maxUpload := cfg.Images.MaxBytes
+	if maxUpload <= 0 {
+		maxUpload = models.DefaultMaxImageBytes
+	}
+	uploadsC := controllers.NewUploads(services.Gallery, services.Image,
+		uploadStore, maxUpload)
+	r.HandleFunc("/galleries/{id:[0-9]+}/uploads", uploadsC.Options).
+		Methods("OPTIONS")
+	r.HandleFunc("/galleries/{id:[0-9]+}/uploads",
+		requireUserMw.ApplyFn(uploadsC.Create)).
+		Methods("POST")
+	r.HandleFunc("/galleries/{id:[0-9]+}/uploads/{uploadID}",
+		requireUserMw.ApplyFn(uploadsC.Head)).
+		Methods("HEAD")
+	r.HandleFunc("/galleries/{id:[0-9]+}/uploads/{uploadID}",
+		requireUserMw.ApplyFn(uploadsC.Patch)).
+		Methods("PATCH")
+	r.HandleFunc("/galleries/{id:[0-9]+}/uploads/{uploadID}",
+		requireUserMw.ApplyFn(uploadsC.Delete)).
+		Methods("DELETE")
+	r.HandleFunc("/galleries/{id:[0-9]+}/images/transfer",
+		requireUserMw.ApplyFn(galleriesC.ImageTransfer)).
+		Methods("POST")
+	r.HandleFunc("/galleries/{id:[0-9]+}/images/order",
+		requireUserMw.ApplyFn(galleriesC.ImageOrder)).
+		Methods("POST")
 	r.HandleFunc("/galleries/{id:[0-9]+}/images/{filename}/delete",
 		requireUserMw.ApplyFn(galleriesC.ImageDelete)).
 		Methods("POST")
+	// Trash
+	trashC := controllers.NewTrash(services.Gallery, services.Image,
+		cfg.Trash.Retention())
+	r.HandleFunc("/trash", requireUserMw.ApplyFn(trashC.Index)).
+		Methods("GET")
+	r.HandleFunc("/trash/galleries/{id:[0-9]+}/restore",
+		requireUserMw.ApplyFn(trashC.GalleryRestore)).
+		Methods("POST")
+	r.HandleFunc("/trash/galleries/{id:[0-9]+}/delete",
+		requireUserMw.ApplyFn(trashC.GalleryDelete)).
+		Methods("POST")
+	r.HandleFunc("/trash/images/{id:[0-9]+}/restore",
+		requireUserMw.ApplyFn(trashC.ImageRestore)).
+		Methods("POST")
+	r.HandleFunc("/trash/images/{id:[0-9]+}/delete",
+		requireUserMw.ApplyFn(trashC.ImageDelete)).
+		Methods("POST")
 	r.HandleFunc("/cookietest", usersC.CookieTest).Methods("GET")
 	r.Handle("/logout", requireUserMw.ApplyFn(usersC.Logout)).Methods("POST")
 	r.Handle("/forgot", usersC.ForgotPwView).Methods("GET")
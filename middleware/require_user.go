@@ -28,11 +28,11 @@ func (mw *User) Apply(next http.Handler) http.HandlerFunc {
 func (mw *User) ApplyFn(next http.HandlerFunc) http.HandlerFunc {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		path := r.URL.Path
-		// If the user is requesting a static asset or image
-		// we will not need to lookup the current user so we skip
-		// doing that
-		if strings.HasPrefix(path, "/assets/") ||
-			strings.HasPrefix(path, "/images/") {
+		// If the user is requesting a static asset we will not
+		// need to lookup the current user so we skip doing that.
+		// Images do need it, since what they look like can depend
+		// on whether the viewer owns the gallery.
+		if strings.HasPrefix(path, "/assets/") {
 			next(w, r)
 			return
 		}
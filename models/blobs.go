@@ -0,0 +1,165 @@
+package models
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"path"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+const (
+	// originalVariant is the name the unmodified image data is
+	// stored under inside of a blob.
+	originalVariant = "original"
+)
+
+// blob is a piece of image data stored once under its SHA-256
+// digest, no matter how many images refer to it. RefCount is
+// the number of image records pointing at the blob, and once
+// it drops to zero the blob is removed from storage. Stored is
+// set once the data of the blob was written, which blobs that
+// existed before we kept track of it all were.
+type blob struct {
+	Digest    string `gorm:"primary_key"`
+	Size      int64
+	RefCount  int  `gorm:"not_null"`
+	Stored    bool `gorm:"not_null;default:true"`
+	CreatedAt time.Time
+}
+
+// blobDB is used to keep track of how many images refer to
+// each blob.
+type blobDB interface {
+	// Acquire adds a reference to the blob with the given
+	// digest, creating the blob record if needed, and reports
+	// whether its data was stored already.
+	Acquire(digest string, size int64) (bool, error)
+	// MarkStored records that the data of the blob with the
+	// given digest was written.
+	MarkStored(digest string) error
+	// Release removes a reference to the blob with the given
+	// digest. If that was the last reference the blob record
+	// is deleted and gc is called before the change is
+	// committed, so nobody can acquire the blob while its data
+	// is being removed. If gc returns an error nothing changes.
+	Release(digest string, gc func() error) error
+}
+
+type blobGorm struct {
+	db *gorm.DB
+}
+
+func (bg *blobGorm) Acquire(digest string, size int64) (bool, error) {
+	// The upsert lets the database settle races between
+	// uploads of the same data for us.
+	row := bg.db.Raw(`INSERT INTO blobs (digest, size, ref_count, stored, created_at)
+		VALUES (?, ?, 1, false, ?)
+		ON CONFLICT (digest) DO UPDATE SET ref_count = blobs.ref_count + 1
+		RETURNING stored`, digest, size, time.Now()).Row()
+	var stored bool
+	if err := row.Scan(&stored); err != nil {
+		return false, err
+	}
+	return stored, nil
+}
+
+func (bg *blobGorm) MarkStored(digest string) error {
+	return bg.db.Model(&blob{}).Where("digest = ?", digest).
+		Update("stored", true).Error
+}
+
+func (bg *blobGorm) Release(digest string, gc func() error) error {
+	tx := bg.db.Begin()
+	if tx.Error != nil {
+		return tx.Error
+	}
+	row := tx.Raw(`UPDATE blobs SET ref_count = ref_count - 1
+		WHERE digest = ? RETURNING ref_count`, digest).Row()
+	var refs int
+	if err := row.Scan(&refs); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if refs <= 0 {
+		err := tx.Where("digest = ?", digest).Delete(&blob{}).Error
+		if err == nil {
+			err = gc()
+		}
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit().Error
+}
+
+// digest returns the hex encoded SHA-256 digest of data.
+func digest(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// blobKey is the storage key of the named variant of the blob
+// with the given digest. Blobs are spread over directories by
+// the first two characters of their digest so that no single
+// directory grows too large.
+func blobKey(digest, variant string) string {
+	return path.Join("blobs", digest[:2], digest, variant)
+}
+
+// storeBlob adds a reference from the image to the blob for
+// data, storing the data unless the blob was stored already.
+// The variants are created later by queueVariants.
+func (is *imageService) storeBlob(i *Image, data []byte) error {
+	i.Digest = digest(data)
+	stored, err := is.blobs.Acquire(i.Digest, int64(len(data)))
+	if err != nil {
+		return err
+	}
+	if stored {
+		// Somebody already uploaded the exact same data.
+		return nil
+	}
+	// Whoever else refers to the blob may still be writing the
+	// data, or may fail to, so we write it as well rather than
+	// point at data that might never be there. It is the same
+	// data, and storage replaces keys in one go, so it doesn't
+	// matter who gets there first.
+	err = is.putBlob(i, data)
+	if err != nil {
+		is.releaseBlob(i.Digest)
+		return err
+	}
+	// If this fails the next upload of the same data just
+	// writes it again.
+	is.blobs.MarkStored(i.Digest)
+	return nil
+}
+
+func (is *imageService) putBlob(i *Image, data []byte) error {
+	key, err := i.key()
+	if err != nil {
+		return err
+	}
+	return is.store.Put(key, i.ContentType, bytes.NewReader(data))
+}
+
+// releaseBlob removes a reference to the blob with the given
+// digest and removes its data once nothing refers to it.
+func (is *imageService) releaseBlob(digest string) error {
+	return is.blobs.Release(digest, func() error {
+		keys := []string{blobKey(digest, originalVariant)}
+		for _, v := range is.cfg.Variants {
+			keys = append(keys, blobKey(digest, v.Name))
+		}
+		for _, key := range keys {
+			if err := is.store.Delete(key); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
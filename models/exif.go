@@ -0,0 +1,448 @@
+package models
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/jpeg"
+	"strings"
+	"time"
+)
+
+const (
+	// originalJPEGQuality is used when an original has to be
+	// re-encoded, eg after correcting its orientation.
+	originalJPEGQuality = 95
+
+	exifTimeLayout = "2006:01:02 15:04:05"
+
+	errBadTIFF modelError = "models: invalid TIFF data"
+
+	// TIFF tags we care about. See the EXIF 2.3 specification.
+	tagMake             = 0x010F
+	tagModel            = 0x0110
+	tagOrientation      = 0x0112
+	tagExifIFD          = 0x8769
+	tagGPSIFD           = 0x8825
+	tagExposureTime     = 0x829A
+	tagFNumber          = 0x829D
+	tagISO              = 0x8827
+	tagDateTimeOriginal = 0x9003
+	tagFocalLength      = 0x920A
+	tagLensModel        = 0xA434
+)
+
+// ImageExif holds the camera details read from the EXIF data
+// of an image. Any of the fields may be empty, since cameras
+// differ in what they record.
+type ImageExif struct {
+	CameraMake   string
+	CameraModel  string
+	LensModel    string
+	ExposureTime string
+	FNumber      float64
+	ISO          int
+	FocalLength  float64
+	TakenAt      *time.Time
+}
+
+// Camera returns the make and model of the camera, without
+// repeating the make when the model already includes it.
+func (e ImageExif) Camera() string {
+	if strings.HasPrefix(e.CameraModel, e.CameraMake) {
+		return e.CameraModel
+	}
+	return strings.TrimSpace(e.CameraMake + " " + e.CameraModel)
+}
+
+// Exposure returns a short summary of the exposure settings,
+// eg "1/125s f/2.8 ISO 100 35mm".
+func (e ImageExif) Exposure() string {
+	var parts []string
+	if e.ExposureTime != "" {
+		parts = append(parts, e.ExposureTime+"s")
+	}
+	if e.FNumber > 0 {
+		parts = append(parts, fmt.Sprintf("f/%g", e.FNumber))
+	}
+	if e.ISO > 0 {
+		parts = append(parts, fmt.Sprintf("ISO %d", e.ISO))
+	}
+	if e.FocalLength > 0 {
+		parts = append(parts, fmt.Sprintf("%gmm", e.FocalLength))
+	}
+	return strings.Join(parts, " ")
+}
+
+// takenAt returns when the image was taken, falling back to
+// when it was uploaded if the EXIF data doesn't say.
+func (i *Image) takenAt() time.Time {
+	if i.Exif.TakenAt != nil {
+		return *i.Exif.TakenAt
+	}
+	return i.CreatedAt
+}
+
+// processExif reads the EXIF data of a jpeg into the image and
+// returns the data we should store for it. The pixels are
+// rotated to match the Orientation tag, and unless the image
+// asks to keep them the GPS tags are removed. Images without
+// EXIF data are returned untouched.
+func processExif(i *Image, data []byte) ([]byte, error) {
+	seg, ok := findExifSegment(data)
+	if !ok {
+		return data, nil
+	}
+	// We modify the EXIF data in place, so work on a copy.
+	data = append([]byte(nil), data...)
+	t, err := newTIFF(data[seg.tiff:seg.end])
+	if err != nil {
+		// Broken EXIF data shouldn't stop an upload, we just
+		// treat the image as if it had none.
+		return data, nil
+	}
+	t.readExif(&i.Exif)
+	if !i.KeepGPS {
+		t.stripGPS()
+	}
+	orientation := t.orientation()
+	if orientation <= 1 || orientation > 8 {
+		return data, nil
+	}
+	// The orientation is about to be applied to the pixels, so
+	// the tag has to say they are upright now.
+	t.setOrientation(1)
+	src, err := jpeg.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	opts := jpeg.Options{Quality: originalJPEGQuality}
+	if err := jpeg.Encode(&buf, orient(src, orientation), &opts); err != nil {
+		return nil, err
+	}
+	// The jpeg encoder doesn't write any EXIF data, so we put
+	// our updated copy back in straight after the SOI marker.
+	out := buf.Bytes()
+	ret := make([]byte, 0, len(out)+seg.end-seg.start)
+	ret = append(ret, out[:2]...)
+	ret = append(ret, data[seg.start:seg.end]...)
+	ret = append(ret, out[2:]...)
+	return ret, nil
+}
+
+// exifSegment holds the offsets of the APP1 segment holding
+// the EXIF data of a jpeg, and of the TIFF data inside of it.
+type exifSegment struct {
+	start, end int
+	tiff       int
+}
+
+// findExifSegment walks the markers of a jpeg looking for the
+// APP1 segment with the EXIF data.
+func findExifSegment(data []byte) (exifSegment, bool) {
+	if len(data) < 4 || data[0] != 0xFF || data[1] != 0xD8 {
+		return exifSegment{}, false
+	}
+	i := 2
+	for i+4 <= len(data) {
+		if data[i] != 0xFF {
+			return exifSegment{}, false
+		}
+		marker := data[i+1]
+		switch {
+		case marker == 0xFF:
+			// Fill byte
+			i++
+			continue
+		case marker == 0x01 || (marker >= 0xD0 && marker <= 0xD7):
+			// Markers without a length
+			i += 2
+			continue
+		case marker == 0xDA || marker == 0xD9:
+			// Start of scan or end of image, EXIF data always
+			// comes before these.
+			return exifSegment{}, false
+		}
+		length := int(binary.BigEndian.Uint16(data[i+2:]))
+		end := i + 2 + length
+		if length < 2 || end > len(data) {
+			return exifSegment{}, false
+		}
+		payload := data[i+4 : end]
+		if marker == 0xE1 && bytes.HasPrefix(payload, []byte("Exif\x00\x00")) {
+			return exifSegment{start: i, end: end, tiff: i + 10}, true
+		}
+		i = end
+	}
+	return exifSegment{}, false
+}
+
+// tiff is a minimal reader and editor for the TIFF structure
+// EXIF data is stored in. All offsets are relative to the
+// start of b, and it is always edited in place so that none of
+// the offsets ever change.
+type tiff struct {
+	b    []byte
+	bo   binary.ByteOrder
+	ifd0 int
+}
+
+type tiffEntry struct {
+	tag   uint16
+	typ   uint16
+	count int
+	// pos is the offset of the entry itself, and off the
+	// offset of its value.
+	pos, off int
+}
+
+// tiffTypeSizes is the size in bytes of each TIFF field type.
+var tiffTypeSizes = map[uint16]int{
+	1: 1, 2: 1, 3: 2, 4: 4, 5: 8, 6: 1, 7: 1, 8: 2, 9: 4, 10: 8, 11: 4, 12: 8,
+}
+
+func newTIFF(b []byte) (*tiff, error) {
+	if len(b) < 8 {
+		return nil, errBadTIFF
+	}
+	t := tiff{b: b}
+	switch string(b[:2]) {
+	case "II":
+		t.bo = binary.LittleEndian
+	case "MM":
+		t.bo = binary.BigEndian
+	default:
+		return nil, errBadTIFF
+	}
+	if t.bo.Uint16(b[2:]) != 42 {
+		return nil, errBadTIFF
+	}
+	t.ifd0 = int(t.bo.Uint32(b[4:]))
+	return &t, nil
+}
+
+// entries returns the entries of the IFD at off. Entries
+// without a value, or with values outside of the data, are
+// skipped, so the value of every entry returned can be read.
+func (t *tiff) entries(off int) []tiffEntry {
+	if off <= 0 || off+2 > len(t.b) {
+		return nil
+	}
+	n := int(t.bo.Uint16(t.b[off:]))
+	var ret []tiffEntry
+	for i := 0; i < n; i++ {
+		pos := off + 2 + i*12
+		if pos+12 > len(t.b) {
+			break
+		}
+		e := tiffEntry{
+			tag:   t.bo.Uint16(t.b[pos:]),
+			typ:   t.bo.Uint16(t.b[pos+2:]),
+			count: int(t.bo.Uint32(t.b[pos+4:])),
+			pos:   pos,
+			off:   pos + 8,
+		}
+		size, ok := tiffTypeSizes[e.typ]
+		if !ok || e.count < 1 || e.count > len(t.b) {
+			continue
+		}
+		if size*e.count > 4 {
+			e.off = int(t.bo.Uint32(t.b[pos+8:]))
+		}
+		if e.off < 0 || e.off+size*e.count > len(t.b) {
+			continue
+		}
+		ret = append(ret, e)
+	}
+	return ret
+}
+
+func (t *tiff) find(ifd int, tag uint16) (tiffEntry, bool) {
+	for _, e := range t.entries(ifd) {
+		if e.tag == tag {
+			return e, true
+		}
+	}
+	return tiffEntry{}, false
+}
+
+func (t *tiff) size(e tiffEntry) int {
+	return tiffTypeSizes[e.typ] * e.count
+}
+
+func (t *tiff) str(e tiffEntry) string {
+	if e.typ != 2 {
+		return ""
+	}
+	s := string(t.b[e.off : e.off+e.count])
+	return strings.TrimSpace(strings.TrimRight(s, "\x00"))
+}
+
+func (t *tiff) intValue(e tiffEntry) int {
+	switch e.typ {
+	case 3:
+		return int(t.bo.Uint16(t.b[e.off:]))
+	case 4:
+		return int(t.bo.Uint32(t.b[e.off:]))
+	}
+	return 0
+}
+
+func (t *tiff) rational(e tiffEntry) (num, den uint32) {
+	if e.typ != 5 && e.typ != 10 {
+		return 0, 0
+	}
+	return t.bo.Uint32(t.b[e.off:]), t.bo.Uint32(t.b[e.off+4:])
+}
+
+func (t *tiff) float(e tiffEntry) float64 {
+	num, den := t.rational(e)
+	if den == 0 {
+		return 0
+	}
+	return float64(num) / float64(den)
+}
+
+// subIFD returns the offset of the IFD the pointer tag in
+// IFD0 refers to, or 0 if there isn't one.
+func (t *tiff) subIFD(tag uint16) int {
+	e, ok := t.find(t.ifd0, tag)
+	if !ok {
+		return 0
+	}
+	return t.intValue(e)
+}
+
+func (t *tiff) readExif(x *ImageExif) {
+	for _, e := range t.entries(t.ifd0) {
+		switch e.tag {
+		case tagMake:
+			x.CameraMake = t.str(e)
+		case tagModel:
+			x.CameraModel = t.str(e)
+		}
+	}
+	for _, e := range t.entries(t.subIFD(tagExifIFD)) {
+		switch e.tag {
+		case tagExposureTime:
+			num, den := t.rational(e)
+			x.ExposureTime = formatExposure(num, den)
+		case tagFNumber:
+			x.FNumber = t.float(e)
+		case tagISO:
+			x.ISO = t.intValue(e)
+		case tagFocalLength:
+			x.FocalLength = t.float(e)
+		case tagLensModel:
+			x.LensModel = t.str(e)
+		case tagDateTimeOriginal:
+			taken, err := time.Parse(exifTimeLayout, t.str(e))
+			if err == nil {
+				x.TakenAt = &taken
+			}
+		}
+	}
+}
+
+// formatExposure turns an exposure time into the form
+// photographers expect, eg "1/125" or "2".
+func formatExposure(num, den uint32) string {
+	switch {
+	case num == 0 || den == 0:
+		return ""
+	case num >= den:
+		return fmt.Sprintf("%g", float64(num)/float64(den))
+	case den%num == 0:
+		return fmt.Sprintf("1/%d", den/num)
+	default:
+		return fmt.Sprintf("%d/%d", num, den)
+	}
+}
+
+func (t *tiff) orientation() int {
+	e, ok := t.find(t.ifd0, tagOrientation)
+	if !ok {
+		return 0
+	}
+	return t.intValue(e)
+}
+
+func (t *tiff) setOrientation(o uint16) {
+	e, ok := t.find(t.ifd0, tagOrientation)
+	if !ok || e.typ != 3 {
+		return
+	}
+	t.bo.PutUint16(t.b[e.off:], o)
+}
+
+// stripGPS zeroes every GPS tag along with their values and
+// leaves behind an empty GPS IFD, so no location data is left
+// in the image.
+func (t *tiff) stripGPS() {
+	off := t.subIFD(tagGPSIFD)
+	if off <= 0 || off+2 > len(t.b) {
+		return
+	}
+	entries := t.entries(off)
+	for _, e := range entries {
+		if size := t.size(e); size > 4 {
+			zero(t.b[e.off : e.off+size])
+		}
+	}
+	n := int(t.bo.Uint16(t.b[off:]))
+	end := off + 2 + n*12
+	if end > len(t.b) {
+		end = len(t.b)
+	}
+	zero(t.b[off:end])
+}
+
+func zero(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
+
+// orient returns src transformed so that it displays upright
+// according to an EXIF orientation between 2 and 8.
+func orient(src image.Image, orientation int) image.Image {
+	b := src.Bounds()
+	rgba := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(rgba, rgba.Bounds(), src, b.Min, draw.Src)
+	w, h := b.Dx(), b.Dy()
+	dw, dh := w, h
+	if orientation >= 5 {
+		dw, dh = h, w
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	for dy := 0; dy < dh; dy++ {
+		for dx := 0; dx < dw; dx++ {
+			var sx, sy int
+			switch orientation {
+			case 2:
+				sx, sy = w-1-dx, dy
+			case 3:
+				sx, sy = w-1-dx, h-1-dy
+			case 4:
+				sx, sy = dx, h-1-dy
+			case 5:
+				sx, sy = dy, dx
+			case 6:
+				sx, sy = dy, h-1-dx
+			case 7:
+				sx, sy = w-1-dy, h-1-dx
+			case 8:
+				sx, sy = w-1-dy, dx
+			default:
+				sx, sy = dx, dy
+			}
+			si := rgba.PixOffset(sx, sy)
+			di := dst.PixOffset(dx, dy)
+			copy(dst.Pix[di:di+4], rgba.Pix[si:si+4])
+		}
+	}
+	return dst
+}
@@ -0,0 +1,239 @@
+package models
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"testing"
+)
+
+// testEntry is an IFD entry for testTIFF. Values of up to 4
+// bytes are stored in the entry, anything longer after the IFD.
+type testEntry struct {
+	tag   uint16
+	typ   uint16
+	count uint32
+	value []byte
+}
+
+// testTIFF builds little endian TIFF data with IFD0 holding
+// entries and, if gps isn't empty, a GPS IFD holding gps.
+func testTIFF(entries, gps []testEntry) []byte {
+	le := binary.LittleEndian
+	ifdSize := func(entries []testEntry) int {
+		n := 2 + len(entries)*12 + 4
+		for _, e := range entries {
+			if len(e.value) > 4 {
+				n += len(e.value)
+			}
+		}
+		return n
+	}
+	ifd0 := 8
+	gpsOff := ifd0 + ifdSize(entries) + 12
+	if len(gps) > 0 {
+		entries = append(entries, testEntry{tagGPSIFD, 4, 1, u32(uint32(gpsOff))})
+	}
+	b := make([]byte, 8)
+	copy(b, "II")
+	le.PutUint16(b[2:], 42)
+	le.PutUint32(b[4:], uint32(ifd0))
+	writeIFD := func(entries []testEntry) {
+		off := len(b)
+		data := off + 2 + len(entries)*12 + 4
+		b = append(b, make([]byte, data-off)...)
+		le.PutUint16(b[off:], uint16(len(entries)))
+		for i, e := range entries {
+			pos := off + 2 + i*12
+			le.PutUint16(b[pos:], e.tag)
+			le.PutUint16(b[pos+2:], e.typ)
+			le.PutUint32(b[pos+4:], e.count)
+			if len(e.value) > 4 {
+				le.PutUint32(b[pos+8:], uint32(len(b)))
+				b = append(b, e.value...)
+			} else {
+				copy(b[pos+8:pos+12], e.value)
+			}
+		}
+	}
+	writeIFD(entries)
+	if len(gps) > 0 {
+		writeIFD(gps)
+	}
+	return b
+}
+
+func u16(v uint16) []byte {
+	b := make([]byte, 2)
+	binary.LittleEndian.PutUint16(b, v)
+	return b
+}
+
+func u32(v uint32) []byte {
+	b := make([]byte, 4)
+	binary.LittleEndian.PutUint32(b, v)
+	return b
+}
+
+// gpsLatitude is a latitude of 51° 30' 26" as three rationals,
+// which is easy to find in the data.
+var gpsLatitude = append(append(append(append(append(
+	u32(51), u32(1)...), u32(30)...), u32(1)...), u32(26)...), u32(1)...)
+
+// testJPEG encodes a w by h jpeg with the TIFF data in an EXIF
+// segment. Its left half is black and its right half white, so
+// that where they end up shows how it was rotated.
+func testJPEG(t *testing.T, w, h int, tiff []byte) []byte {
+	img := image.NewGray(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := w / 2; x < w; x++ {
+			img.SetGray(x, y, color.Gray{Y: 255})
+		}
+	}
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: 100}); err != nil {
+		t.Fatal(err)
+	}
+	out := buf.Bytes()
+	seg := []byte{0xFF, 0xE1, 0, 0}
+	binary.BigEndian.PutUint16(seg[2:], uint16(2+6+len(tiff)))
+	seg = append(seg, "Exif\x00\x00"...)
+	seg = append(seg, tiff...)
+	ret := append([]byte(nil), out[:2]...)
+	ret = append(ret, seg...)
+	return append(ret, out[2:]...)
+}
+
+func TestOrient(t *testing.T) {
+	// Every pixel of the 3x2 source records where it came from.
+	const w, h = 3, 2
+	src := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			src.SetRGBA(x, y, color.RGBA{uint8(x), uint8(y), 0, 255})
+		}
+	}
+	type pt struct{ x, y int }
+	tests := []struct {
+		orientation int
+		size        pt
+		// topLeft and topRight are the source pixels that end
+		// up in the top corners once the image is upright.
+		topLeft, topRight pt
+	}{
+		{1, pt{3, 2}, pt{0, 0}, pt{2, 0}},
+		{2, pt{3, 2}, pt{2, 0}, pt{0, 0}}, // mirrored
+		{3, pt{3, 2}, pt{2, 1}, pt{0, 1}}, // rotated 180°
+		{4, pt{3, 2}, pt{0, 1}, pt{2, 1}}, // flipped
+		{5, pt{2, 3}, pt{0, 0}, pt{0, 1}}, // transposed
+		{6, pt{2, 3}, pt{0, 1}, pt{0, 0}}, // rotated 90° clockwise
+		{7, pt{2, 3}, pt{2, 1}, pt{2, 0}}, // transversed
+		{8, pt{2, 3}, pt{2, 0}, pt{2, 1}}, // rotated 90° counterclockwise
+	}
+	for _, tc := range tests {
+		dst := orient(src, tc.orientation)
+		b := dst.Bounds()
+		if b.Dx() != tc.size.x || b.Dy() != tc.size.y {
+			t.Errorf("orientation %d: size = %dx%d, want %dx%d", tc.orientation,
+				b.Dx(), b.Dy(), tc.size.x, tc.size.y)
+			continue
+		}
+		for _, c := range []struct {
+			x    int
+			want pt
+		}{{0, tc.topLeft}, {b.Dx() - 1, tc.topRight}} {
+			r, g, _, _ := dst.At(c.x, 0).RGBA()
+			got := pt{int(r >> 8), int(g >> 8)}
+			if got != c.want {
+				t.Errorf("orientation %d: pixel (%d, 0) came from %v, want %v",
+					tc.orientation, c.x, got, c.want)
+			}
+		}
+	}
+}
+
+func TestProcessExif(t *testing.T) {
+	gps := []testEntry{
+		{0x0001, 2, 2, []byte("N\x00")},
+		{0x0002, 5, 3, gpsLatitude},
+	}
+	tests := []struct {
+		name        string
+		orientation uint16
+		keepGPS     bool
+		// width and height of the result, and whether its top
+		// left corner is white.
+		w, h  int
+		white bool
+	}{
+		{"upright", 1, false, 8, 4, false},
+		{"rotated 90° clockwise", 6, false, 4, 8, false},
+		{"rotated 180°", 3, false, 8, 4, true},
+		{"rotated 90° counterclockwise", 8, false, 4, 8, true},
+		{"keeping GPS", 6, true, 4, 8, false},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			tiff := testTIFF([]testEntry{
+				{tagOrientation, 3, 1, u16(tc.orientation)},
+			}, gps)
+			i := Image{KeepGPS: tc.keepGPS}
+			data, err := processExif(&i, testJPEG(t, 8, 4, tiff))
+			if err != nil {
+				t.Fatal(err)
+			}
+			img, err := jpeg.Decode(bytes.NewReader(data))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if b := img.Bounds(); b.Dx() != tc.w || b.Dy() != tc.h {
+				t.Errorf("size = %dx%d, want %dx%d", b.Dx(), b.Dy(), tc.w, tc.h)
+			}
+			y, _, _, _ := img.At(0, 0).RGBA()
+			if white := y > 0x8000; white != tc.white {
+				t.Errorf("top left corner white = %v, want %v", white, tc.white)
+			}
+			seg, ok := findExifSegment(data)
+			if !ok {
+				t.Fatal("the EXIF data was dropped")
+			}
+			out, err := newTIFF(data[seg.tiff:seg.end])
+			if err != nil {
+				t.Fatal(err)
+			}
+			if o := out.orientation(); o != 1 {
+				t.Errorf("orientation = %d, want 1", o)
+			}
+			if kept := bytes.Contains(data, gpsLatitude); kept != tc.keepGPS {
+				t.Errorf("GPS data kept = %v, want %v", kept, tc.keepGPS)
+			}
+		})
+	}
+}
+
+// TestTIFFEntriesWithoutValue makes sure entries with a count of
+// 0, which have no value to read, can't make us read past the
+// end of the data.
+func TestTIFFEntriesWithoutValue(t *testing.T) {
+	for _, typ := range []uint16{3, 4, 5, 10} {
+		b := testTIFF([]testEntry{
+			{tagOrientation, typ, 0, nil},
+			{tagExifIFD, typ, 0, nil},
+		}, nil)
+		// Cut off the offset of the next IFD, so the last entry
+		// ends right at the end of the data.
+		b = b[:len(b)-4]
+		tiff, err := newTIFF(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if o := tiff.orientation(); o != 0 {
+			t.Errorf("type %d: orientation = %d, want 0", typ, o)
+		}
+		var x ImageExif
+		tiff.readExif(&x)
+		tiff.stripGPS()
+	}
+}
@@ -0,0 +1,142 @@
+package models
+
+import (
+	"fmt"
+	"path"
+	"path/filepath"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	// maxFilenameLength is the longest filename, in bytes, most
+	// filesystems will let us create.
+	maxFilenameLength = 255
+
+	ErrFilenameInvalid modelError = "models: filename is not valid"
+	ErrFilenameTaken   modelError = "models: an image with that " +
+		"filename already exists in this gallery"
+	ErrCollisionPolicyInvalid modelError = "models: image " +
+		"collision policy is not valid"
+)
+
+// CollisionPolicy decides what happens when an image is
+// uploaded to a gallery that already has an image with the
+// same filename.
+type CollisionPolicy string
+
+const (
+	// CollisionRename stores the new image under a new name by
+	// adding a number to it, eg "photo-1.jpg".
+	CollisionRename CollisionPolicy = "rename"
+	// CollisionReplace replaces the existing image.
+	CollisionReplace CollisionPolicy = "replace"
+	// CollisionReject refuses the upload with ErrFilenameTaken.
+	CollisionReject CollisionPolicy = "reject"
+)
+
+func (cp CollisionPolicy) valid() bool {
+	switch cp {
+	case CollisionRename, CollisionReplace, CollisionReject:
+		return true
+	}
+	return false
+}
+
+// sanitizeFilename normalizes a client supplied filename and
+// rejects anything that could be used to escape the gallery
+// directory. Surrounding whitespace is trimmed and the file
+// extension is lowercased.
+func sanitizeFilename(name string) (string, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return "", ErrFilenameRequired
+	}
+	if len(name) > maxFilenameLength ||
+		strings.ContainsAny(name, `/\:`) ||
+		strings.Contains(name, "..") ||
+		strings.HasPrefix(name, ".") {
+		return "", ErrFilenameInvalid
+	}
+	for _, r := range name {
+		if unicode.IsControl(r) || r == unicode.ReplacementChar {
+			return "", ErrFilenameInvalid
+		}
+	}
+	ext := filepath.Ext(name)
+	return strings.TrimSuffix(name, ext) + strings.ToLower(ext), nil
+}
+
+// containedPath joins filename onto the slash separated dir
+// and makes sure the result is directly inside dir. This is
+// our last line of defence, so every storage key built from a
+// filename should go through it.
+func containedPath(dir, filename string) (string, error) {
+	dir = path.Clean(dir)
+	p := path.Join(dir, filename)
+	if p == dir || path.Dir(p) != dir || path.Base(p) != filename {
+		return "", ErrFilenameInvalid
+	}
+	return p, nil
+}
+
+// numberedFilename adds n to the end of the filename, before
+// the extension. eg "photo.jpg" becomes "photo-2.jpg". The
+// filename is shortened to make room for the number if it
+// would otherwise be longer than maxFilenameLength.
+func numberedFilename(filename string, n int) string {
+	ext := filepath.Ext(filename)
+	base := strings.TrimSuffix(filename, ext)
+	suffix := fmt.Sprintf("-%d", n)
+	if len(suffix)+len(ext) > maxFilenameLength {
+		// The "extension" is most of the filename, so it is
+		// shortened like the rest of it.
+		base, ext = filename, ""
+	}
+	for len(base)+len(suffix)+len(ext) > maxFilenameLength {
+		_, size := utf8.DecodeLastRuneInString(base)
+		base = base[:len(base)-size]
+	}
+	return base + suffix + ext
+}
+
+// resolveCollision applies the configured collision policy to
+// the image. If the policy is to replace an existing image,
+// that image is returned so its record can be reused.
+func (is *imageService) resolveCollision(i *Image) (*Image, error) {
+	existing, err := is.ByFilename(i.GalleryID, i.Filename)
+	switch err {
+	case nil:
+	case ErrNotFound:
+		return nil, nil
+	default:
+		return nil, err
+	}
+	switch is.cfg.Collision {
+	case CollisionReplace:
+		return existing, nil
+	case CollisionReject:
+		return nil, ErrFilenameTaken
+	}
+	return nil, is.renameToFree(i)
+}
+
+// renameToFree adds a number to the filename of the image, eg
+// "photo-1.jpg", until no other image in its gallery uses it.
+// Filenames that are already free are left alone.
+func (is *imageService) renameToFree(i *Image) error {
+	original := i.Filename
+	for n := 0; ; n++ {
+		if n > 0 {
+			i.Filename = numberedFilename(original, n)
+		}
+		_, err := is.ByFilename(i.GalleryID, i.Filename)
+		if err == ErrNotFound {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,79 @@
+package models
+
+import (
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestSanitizeFilename(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+		err  error
+	}{
+		{"photo.jpg", "photo.jpg", nil},
+		{"  photo.jpg  ", "photo.jpg", nil},
+		{"Photo.JPG", "Photo.jpg", nil},
+		{"my holiday photo.jpeg", "my holiday photo.jpeg", nil},
+		{"café.png", "café.png", nil},
+		{strings.Repeat("a", 251) + ".jpg", strings.Repeat("a", 251) + ".jpg", nil},
+		{"", "", ErrFilenameRequired},
+		{"   ", "", ErrFilenameRequired},
+		{strings.Repeat("a", 252) + ".jpg", "", ErrFilenameInvalid},
+		{"../photo.jpg", "", ErrFilenameInvalid},
+		{"..", "", ErrFilenameInvalid},
+		{"photo..jpg", "", ErrFilenameInvalid},
+		{"dir/photo.jpg", "", ErrFilenameInvalid},
+		{`dir\photo.jpg`, "", ErrFilenameInvalid},
+		{"C:photo.jpg", "", ErrFilenameInvalid},
+		{".hidden.jpg", "", ErrFilenameInvalid},
+		{"photo\x00.jpg", "", ErrFilenameInvalid},
+		{"photo\n.jpg", "", ErrFilenameInvalid},
+		{"photo\xff.jpg", "", ErrFilenameInvalid},
+	}
+	for _, tc := range tests {
+		got, err := sanitizeFilename(tc.name)
+		if got != tc.want || err != tc.err {
+			t.Errorf("sanitizeFilename(%q) = %q, %v, want %q, %v",
+				tc.name, got, err, tc.want, tc.err)
+		}
+	}
+}
+
+func TestNumberedFilename(t *testing.T) {
+	long := strings.Repeat("a", 251)
+	tests := []struct {
+		filename string
+		n        int
+		want     string
+	}{
+		{"photo.jpg", 1, "photo-1.jpg"},
+		{"photo.jpg", 12, "photo-12.jpg"},
+		{"photo", 2, "photo-2"},
+		{"archive.tar.gz", 3, "archive.tar-3.gz"},
+		{long + ".jpg", 2, long[:249] + "-2.jpg"},
+		{long + ".jpg", 10, long[:248] + "-10.jpg"},
+		// Multi-byte characters are never cut in half.
+		{strings.Repeat("é", 125) + "a.jpg", 2, strings.Repeat("é", 124) + "-2.jpg"},
+		// An extension that takes up the whole filename is
+		// shortened too.
+		{"a." + strings.Repeat("b", 253), 2, "a." + strings.Repeat("b", 251) + "-2"},
+	}
+	for _, tc := range tests {
+		got := numberedFilename(tc.filename, tc.n)
+		if got != tc.want {
+			t.Errorf("numberedFilename(%q, %d) = %q, want %q", tc.filename, tc.n, got, tc.want)
+		}
+		if len(got) > maxFilenameLength {
+			t.Errorf("numberedFilename(%q, %d) is %d bytes long", tc.filename, tc.n, len(got))
+		}
+		if !utf8.ValidString(got) {
+			t.Errorf("numberedFilename(%q, %d) = %q is not valid UTF-8", tc.filename, tc.n, got)
+		}
+		if _, err := sanitizeFilename(got); err != nil && len(tc.filename) <= maxFilenameLength {
+			t.Errorf("numberedFilename(%q, %d) = %q doesn't pass sanitizeFilename: %v",
+				tc.filename, tc.n, got, err)
+		}
+	}
+}
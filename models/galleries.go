@@ -1,17 +1,96 @@
 package models
 
-import "github.com/jinzhu/gorm"
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
 
+	"github.com/jinzhu/gorm"
+
+	"github.com/yakushou730/golang-web-course/rand"
+)
+
+const (
+	ErrUserIDRequired    modelError = "models: user ID is required"
+	ErrTitleRequired     modelError = "models: title is required"
+	ErrSortModeInvalid   modelError = "models: sort mode is not valid"
+	ErrVisibilityInvalid modelError = "models: visibility is not valid"
+
+	// slugBytes is how many random bytes go into the slug of an
+	// unlisted gallery.
+	slugBytes = 12
+)
+
+// Who can see a gallery and its images. The owner can always
+// see their own galleries.
+const (
+	// VisibilityPrivate galleries can only be seen by their
+	// owner.
+	VisibilityPrivate = "private"
+	// VisibilityUnlisted galleries can be seen by anyone with
+	// the link to them, which has a random Slug in it rather than
+	// the gallery ID so it can't be guessed.
+	VisibilityUnlisted = "unlisted"
+	// VisibilityPublic galleries can be seen by anyone.
+	VisibilityPublic = "public"
+)
+
+// Visibilities lists every valid Gallery.Visibility.
+var Visibilities = []string{VisibilityPrivate, VisibilityUnlisted, VisibilityPublic}
+
+// The ways the images in a gallery can be sorted.
 const (
-	ErrUserIDRequired modelError = "models: user ID is required"
-	ErrTitleRequired  modelError = "models: title is required"
+	// SortManual uses the order set by the gallery owner.
+	SortManual = "manual"
+	// SortFilename sorts by filename, ignoring case.
+	SortFilename = "filename"
+	// SortUploaded sorts by upload time, oldest first.
+	SortUploaded = "uploaded"
+	// SortTaken sorts by the EXIF capture time, oldest first.
+	// Images without one are sorted by upload time instead.
+	SortTaken = "taken"
 )
 
+// SortModes lists every valid Gallery.SortMode.
+var SortModes = []string{SortManual, SortFilename, SortUploaded, SortTaken}
+
 type Gallery struct {
 	gorm.Model
-	UserID uint    `gorm:"not_null;index"`
-	Title  string  `gorm:"not_null"`
-	Images []Image `gorm:"-"`
+	UserID uint   `gorm:"not_null;index"`
+	Title  string `gorm:"not_null"`
+	// KeepGPS keeps the GPS location in the EXIF data of images
+	// uploaded to this gallery. It is stripped by default.
+	KeepGPS bool
+	// SortMode is one of SortModes and decides the order the
+	// images in this gallery are shown in.
+	SortMode string `gorm:"not_null;default:'manual'"`
+	// CoverImageID is the image the owner picked to represent
+	// the gallery, or 0 to use the first image.
+	CoverImageID uint
+	// DownloadOriginals lets viewers download the original
+	// images, one at a time or in a ZIP of the gallery. When it
+	// is off they get the display sized copies instead.
+	DownloadOriginals bool
+	// Visibility is one of Visibilities and decides who can see
+	// the gallery. Slug is only set while it is unlisted, and a
+	// new one is made every time it becomes unlisted again so
+	// old links stop working. Slugs are unique among the
+	// galleries that have one, see Services.AutoMigrate.
+	Visibility string `gorm:"not_null;default:'private'"`
+	Slug       string `gorm:"not_null;default:''"`
+	// Watermark settings. When WatermarkEnabled is set the
+	// images are marked with the PNG stored under WatermarkKey,
+	// or with WatermarkText if there is no PNG. See Watermarked.
+	WatermarkEnabled  bool
+	WatermarkText     string
+	WatermarkKey      string
+	WatermarkPosition string  `gorm:"not_null;default:'bottom-right'"`
+	WatermarkOpacity  int     `gorm:"not_null;default:50"`
+	Images            []Image `gorm:"-"`
+	// Cover is the image representing the gallery. It is only
+	// set after calling ImageService.SetCovers.
+	Cover *Image `gorm:"-"`
 }
 
 type GalleryService interface {
@@ -28,10 +107,29 @@ type GalleryService interface {
 // an error generated by the models package.
 type GalleryDB interface {
 	ByID(id uint) (*Gallery, error)
+	// BySlug returns the unlisted gallery with the given slug.
+	BySlug(slug string) (*Gallery, error)
 	ByUserID(userID uint) ([]Gallery, error)
 	Create(gallery *Gallery) error
 	Update(gallery *Gallery) error
+	// Delete moves the gallery to the trash. Its images stay
+	// where they are until the gallery is purged.
 	Delete(id uint) error
+	// Purge removes the gallery for good, whether or not it was
+	// deleted first. Use Services.PurgeGallery to remove its
+	// images along with it.
+	Purge(id uint) error
+	// Deleted returns the user's galleries that are in the
+	// trash, most recently deleted first.
+	Deleted(userID uint) ([]Gallery, error)
+	// DeletedByID returns the gallery in the trash with the
+	// given ID, or ErrNotFound.
+	DeletedByID(id uint) (*Gallery, error)
+	// DeletedBefore returns the galleries that were deleted
+	// before t.
+	DeletedBefore(t time.Time) ([]Gallery, error)
+	// Restore takes the gallery out of the trash.
+	Restore(id uint) error
 }
 
 type galleryGorm struct {
@@ -85,10 +183,56 @@ func (gv *galleryValidator) titleRequired(g *Gallery) error {
 	return nil
 }
 
+func (gv *galleryValidator) sortModeValid(g *Gallery) error {
+	if g.SortMode == "" {
+		g.SortMode = SortManual
+	}
+	for _, mode := range SortModes {
+		if g.SortMode == mode {
+			return nil
+		}
+	}
+	return ErrSortModeInvalid
+}
+
+func (gv *galleryValidator) visibilityValid(g *Gallery) error {
+	if g.Visibility == "" {
+		g.Visibility = VisibilityPrivate
+	}
+	for _, v := range Visibilities {
+		if g.Visibility == v {
+			return nil
+		}
+	}
+	return ErrVisibilityInvalid
+}
+
+// setSlug makes sure unlisted galleries have a slug and no
+// other gallery does.
+func (gv *galleryValidator) setSlug(g *Gallery) error {
+	if g.Visibility != VisibilityUnlisted {
+		g.Slug = ""
+		return nil
+	}
+	if g.Slug != "" {
+		return nil
+	}
+	slug, err := rand.String(slugBytes)
+	if err != nil {
+		return err
+	}
+	g.Slug = slug
+	return nil
+}
+
 func (gv *galleryValidator) Create(gallery *Gallery) error {
 	err := runGalleryValFns(gallery,
 		gv.userIDRequired,
-		gv.titleRequired)
+		gv.titleRequired,
+		gv.sortModeValid,
+		gv.visibilityValid,
+		gv.setSlug,
+		gv.watermarkValid)
 	if err != nil {
 		return err
 	}
@@ -105,6 +249,25 @@ func (gg *galleryGorm) ByID(id uint) (*Gallery, error) {
 	return &gallery, nil
 }
 
+func (gv *galleryValidator) BySlug(slug string) (*Gallery, error) {
+	// Galleries that aren't unlisted have an empty slug, which
+	// must never find one of them.
+	if slug == "" {
+		return nil, ErrNotFound
+	}
+	return gv.GalleryDB.BySlug(slug)
+}
+
+func (gg *galleryGorm) BySlug(slug string) (*Gallery, error) {
+	var gallery Gallery
+	db := gg.db.Where("slug = ? AND visibility = ?", slug, VisibilityUnlisted)
+	err := first(db, &gallery)
+	if err != nil {
+		return nil, err
+	}
+	return &gallery, nil
+}
+
 func (gg *galleryGorm) Update(gallery *Gallery) error {
 	return gg.db.Save(gallery).Error
 }
@@ -112,7 +275,11 @@ func (gg *galleryGorm) Update(gallery *Gallery) error {
 func (gv *galleryValidator) Update(gallery *Gallery) error {
 	err := runGalleryValFns(gallery,
 		gv.userIDRequired,
-		gv.titleRequired)
+		gv.titleRequired,
+		gv.sortModeValid,
+		gv.visibilityValid,
+		gv.setSlug,
+		gv.watermarkValid)
 	if err != nil {
 		return err
 	}
@@ -126,6 +293,51 @@ func (gg *galleryGorm) Delete(id uint) error {
 	return gg.db.Delete(&gallery).Error
 }
 
+func (gg *galleryGorm) Purge(id uint) error {
+	gallery := Gallery{
+		Model: gorm.Model{ID: id},
+	}
+	return gg.db.Unscoped().Delete(&gallery).Error
+}
+
+func (gg *galleryGorm) Deleted(userID uint) ([]Gallery, error) {
+	var galleries []Gallery
+	err := gg.db.Unscoped().
+		Where("user_id = ? AND deleted_at IS NOT NULL", userID).
+		Order("deleted_at DESC").
+		Find(&galleries).Error
+	if err != nil {
+		return nil, err
+	}
+	return galleries, nil
+}
+
+func (gg *galleryGorm) DeletedByID(id uint) (*Gallery, error) {
+	var gallery Gallery
+	db := gg.db.Unscoped().Where("id = ? AND deleted_at IS NOT NULL", id)
+	err := first(db, &gallery)
+	if err != nil {
+		return nil, err
+	}
+	return &gallery, nil
+}
+
+func (gg *galleryGorm) Restore(id uint) error {
+	return gg.db.Unscoped().Model(&Gallery{}).Where("id = ?", id).
+		UpdateColumn("deleted_at", nil).Error
+}
+
+func (gg *galleryGorm) DeletedBefore(t time.Time) ([]Gallery, error) {
+	var galleries []Gallery
+	err := gg.db.Unscoped().
+		Where("deleted_at IS NOT NULL AND deleted_at < ?", t).
+		Find(&galleries).Error
+	if err != nil {
+		return nil, err
+	}
+	return galleries, nil
+}
+
 func (gv *galleryValidator) nonZeroID(gallery *Gallery) error {
 	if gallery.ID <= 0 {
 		return ErrIDInvalid
@@ -142,6 +354,15 @@ func (gv *galleryValidator) Delete(id uint) error {
 	return gv.GalleryDB.Delete(gallery.ID)
 }
 
+func (gv *galleryValidator) Purge(id uint) error {
+	var gallery Gallery
+	gallery.ID = id
+	if err := runGalleryValFns(&gallery, gv.nonZeroID); err != nil {
+		return err
+	}
+	return gv.GalleryDB.Purge(gallery.ID)
+}
+
 func (gg *galleryGorm) ByUserID(userID uint) ([]Gallery, error) {
 	var galleries []Gallery
 	// We build this query *exactly* the same way we build
@@ -156,6 +377,15 @@ func (gg *galleryGorm) ByUserID(userID uint) ([]Gallery, error) {
 	return galleries, nil
 }
 
+// Path is the path the gallery is shown at. Unlisted galleries
+// are shown at their slug, so that is the link to share.
+func (g *Gallery) Path() string {
+	if g.Visibility == VisibilityUnlisted && g.Slug != "" {
+		return "/g/" + g.Slug
+	}
+	return fmt.Sprintf("/galleries/%d", g.ID)
+}
+
 func (g *Gallery) ImagesSplitN(n int) [][]Image {
 	ret := make([][]Image, n)
 	for i := 0; i < n; i++ {
@@ -167,3 +397,30 @@ func (g *Gallery) ImagesSplitN(n int) [][]Image {
 	}
 	return ret
 }
+
+// SortImages sorts the gallery's images using its SortMode.
+func (g *Gallery) SortImages() {
+	images := g.Images
+	var less func(a, b *Image) bool
+	switch g.SortMode {
+	case SortFilename:
+		less = func(a, b *Image) bool {
+			return strings.ToLower(a.Filename) < strings.ToLower(b.Filename)
+		}
+	case SortUploaded:
+		less = func(a, b *Image) bool {
+			return a.CreatedAt.Before(b.CreatedAt)
+		}
+	case SortTaken:
+		less = func(a, b *Image) bool {
+			return a.takenAt().Before(b.takenAt())
+		}
+	default:
+		less = func(a, b *Image) bool {
+			return a.Position < b.Position
+		}
+	}
+	sort.SliceStable(images, func(i, j int) bool {
+		return less(&images[i], &images[j])
+	})
+}
@@ -0,0 +1,110 @@
+package models
+
+import (
+	"bytes"
+	"image"
+	"io"
+	"io/ioutil"
+	"net/http"
+)
+
+const (
+	// DefaultMaxImageBytes is the largest image file we accept
+	// when the ImageConfig doesn't say otherwise.
+	DefaultMaxImageBytes = 20 << 20 // 20 megabytes
+	// DefaultMaxImageDimension is the largest width or height,
+	// in pixels, we accept when the ImageConfig doesn't say
+	// otherwise.
+	DefaultMaxImageDimension = 10000
+
+	ErrImageFormat modelError = "models: only jpg, jpeg, and png " +
+		"images are supported"
+	ErrImageTooLarge   modelError = "models: image file is too large"
+	ErrImageDimensions modelError = "models: image width or " +
+		"height is too large"
+
+	// The errors below are used when importing a ZIP archive of
+	// images.
+	ErrImportArchive modelError = "models: that file is not a " +
+		"valid ZIP archive"
+	ErrImportTooManyFiles modelError = "models: the archive " +
+		"contains too many files"
+	ErrImportTooLarge modelError = "models: the archive expands " +
+		"to too much data"
+	ErrImportPath modelError = "models: the file is in a folder " +
+		"outside of the archive"
+	ErrImportRatio modelError = "models: the file is compressed " +
+		"too well to be an image"
+)
+
+// allowedImageTypes maps the content types we accept to the
+// format name image.DecodeConfig reports for them.
+var allowedImageTypes = map[string]string{
+	"image/jpeg": "jpeg",
+	"image/png":  "png",
+}
+
+// ImageConfig is used to configure the ImageService.
+type ImageConfig struct {
+	// Storage is where the image data is kept. Defaults to the
+	// local "images" directory.
+	Storage  Storage
+	Variants []ImageVariant
+	// MaxBytes is the largest file size accepted.
+	MaxBytes int64
+	// MaxWidth and MaxHeight are the largest dimensions, in
+	// pixels, accepted.
+	MaxWidth  int
+	MaxHeight int
+	// Collision decides what happens when an upload has the
+	// same filename as an existing image. Defaults to
+	// CollisionRename.
+	Collision CollisionPolicy
+	// Signer signs the paths returned by Image.Path and the
+	// variant path methods. When it is nil the paths are not
+	// signed and VerifyURL accepts any request.
+	Signer *URLSigner
+	// ResizeSizes are the widths and heights images can be
+	// resized to on request. Defaults to DefaultResizeSizes.
+	ResizeSizes []int
+	// ResizeCache keeps images resized on request. When it is
+	// nil every request resizes the image again.
+	ResizeCache *ResizeCache
+	// DefaultQuota is how many bytes of images each user may
+	// store, unless they have a quota of their own. 0 means
+	// there is no limit.
+	DefaultQuota int64
+}
+
+// readImageData reads all of the image data from r and
+// verifies that it is an image we accept. The content type and
+// size of the image are set as it goes. We never trust the
+// filename extension here, only the bytes themselves.
+func (is *imageService) readImageData(i *Image, r io.Reader) ([]byte, error) {
+	// Read one byte past the limit so we can tell when a file
+	// is too large without reading the rest of it.
+	data, err := ioutil.ReadAll(io.LimitReader(r, is.cfg.MaxBytes+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > is.cfg.MaxBytes {
+		return nil, ErrImageTooLarge
+	}
+	contentType := http.DetectContentType(data)
+	format, ok := allowedImageTypes[contentType]
+	if !ok {
+		return nil, ErrImageFormat
+	}
+	// The sniffed content type only looks at the first bytes,
+	// so we also make sure the image header can be decoded.
+	cfg, decoded, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil || decoded != format {
+		return nil, ErrImageFormat
+	}
+	if cfg.Width > is.cfg.MaxWidth || cfg.Height > is.cfg.MaxHeight {
+		return nil, ErrImageDimensions
+	}
+	i.ContentType = contentType
+	i.Size = int64(len(data))
+	return data, nil
+}
@@ -4,98 +4,953 @@ import (
 	"fmt"
 	"io"
 	"net/url"
-	"os"
-	"path/filepath"
+	"path"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/jinzhu/gorm"
+)
+
+const (
+	// maxImageTextLength is the longest title or alt text, and
+	// maxCaptionLength the longest caption, we accept.
+	maxImageTextLength = 255
+	maxCaptionLength   = 2000
+
+	ErrGalleryIDRequired modelError = "models: gallery ID is required"
+	ErrImageTextTooLong  modelError = "models: image title and alt " +
+		"text must be at most 255 characters long"
+	ErrCaptionTooLong modelError = "models: image caption must be " +
+		"at most 2000 characters long"
+	ErrFilenameRequired  modelError = "models: filename is required"
+	ErrImageOrderInvalid modelError = "models: the new order must " +
+		"include every image in the gallery exactly once"
 )
 
 // Image is used to represent images stored in a Gallery.
-// Image is NOT stored in the database, and instead
-// references data stored on disk.
+// The image data itself is kept in Storage, while everything
+// we know about it (owner, size, upload time, etc) is stored
+// in the images table.
 type Image struct {
-	GalleryID uint
-	Filename  string
+	gorm.Model
+	// GalleryID and Filename are unique among the images that
+	// aren't in the trash. See Services.AutoMigrate.
+	GalleryID   uint   `gorm:"not_null;index"`
+	UserID      uint   `gorm:"not_null;index"`
+	Filename    string `gorm:"not_null"`
+	ContentType string
+	Size        int64
+	// Digest is the SHA-256 digest of the image data, which is
+	// stored once as a blob no matter how many images use it.
+	Digest string    `gorm:"index"`
+	Exif   ImageExif `gorm:"embedded;embedded_prefix:exif_"`
+	// Position is where the image goes in its gallery when the
+	// gallery is sorted manually.
+	Position int `gorm:"not_null;default:0"`
+	Title    string
+	Caption  string `gorm:"type:text"`
+	AltText  string
+	// KeepGPS is set when creating an image to keep the GPS
+	// tags in its EXIF data. They are removed by default.
+	KeepGPS bool `gorm:"-"`
+	// Processing is set while the variants of the image are
+	// being created in the background. Until they are ready the
+	// original is used in their place.
+	Processing bool `gorm:"not_null;default:false"`
+	// Width and Height are the size of the original image, and
+	// Color its dominant color as a CSS hex color. Placeholder
+	// is a tiny blurred copy of it as a data URI, which is empty
+	// for transparent images. Pages use them to reserve space
+	// for the image and show something while it loads. They are
+	// all set by Create, so images uploaded before we started
+	// keeping track of them don't have them.
+	Width       int
+	Height      int
+	Color       string
+	Placeholder string `gorm:"type:text"`
+	// signer is set on images loaded by an ImageService that
+	// signs image URLs.
+	signer *URLSigner
+	// slug is set by SetGallerySlug.
+	slug string
 }
 
+// ImageService is used to work with images. Unlike the
+// ImageDB it keeps the image data in Storage in sync with the
+// images table.
 type ImageService interface {
-	Create(galleryID uint, r io.Reader, filename string) error
+	// Create will write the data read from r to storage, along
+	// with a resized copy for every configured variant, and then
+	// create a record for the image. The image must have its
+	// GalleryID, UserID and Filename set. The filename is
+	// sanitized first, and if an image with the same filename
+	// already exists in the gallery the configured
+	// CollisionPolicy decides what happens.
+	//
+	// If the data isn't an image we accept one of ErrImageFormat,
+	// ErrImageTooLarge or ErrImageDimensions is returned, and if
+	// storing it would take the user over their storage quota
+	// ErrStorageQuotaExceeded is returned.
+	//
+	// Any EXIF data is read into the image's Exif field, the
+	// pixels are rotated to match the EXIF orientation and, unless
+	// KeepGPS is set, the GPS tags are removed before storing.
+	// Its Width, Height, Color and Placeholder are set from the
+	// data as well.
+	//
+	// The variants are created in the background by a
+	// JobImageVariants job, and the image is Processing until
+	// they are done.
+	Create(image *Image, r io.Reader) error
+	// ProcessVariants is the JobHandler for JobImageVariants
+	// jobs.
+	ProcessVariants(job *Job) error
+	ByID(id uint) (*Image, error)
 	ByGalleryID(galleryID uint) ([]Image, error)
-	Delete(i *Image) error
+	ByFilename(galleryID uint, filename string) (*Image, error)
+	// Search returns the images owned by the user whose title,
+	// caption or alt text contain the query, ignoring case.
+	Search(userID uint, query string) ([]Image, error)
+	// Update saves changes to the image record, such as its
+	// title, caption and alt text.
+	Update(image *Image) error
+	// SetCovers looks up the cover image of every gallery and
+	// sets it as the gallery's Cover. Galleries without a cover
+	// image use their first image. Only two queries are made no
+	// matter how many galleries there are.
+	SetCovers(galleries []Gallery) error
+	// Reorder sets the manual order of the images in a gallery.
+	// ids must hold the ID of every image in the gallery exactly
+	// once, otherwise ErrImageOrderInvalid is returned.
+	Reorder(galleryID uint, ids []uint) error
+	// Copy adds a copy of the image to the gallery with the
+	// given ID, renaming the copy if the filename is taken.
+	Copy(image *Image, galleryID uint) (*Image, error)
+	// Move moves the image to the gallery with the given ID,
+	// renaming it if the filename is taken.
+	Move(image *Image, galleryID uint) error
+	// DeleteByGalleryID purges every image in the gallery, even
+	// those in the trash, along with any other files left in the
+	// gallery's directories.
+	DeleteByGalleryID(galleryID uint) error
+	// Orphans returns the files in storage that nothing refers
+	// to, and the images whose gallery no longer exists.
+	Orphans() ([]Orphan, error)
+	// RemoveOrphan deletes an orphan returned by Orphans.
+	RemoveOrphan(o Orphan) error
+	// Usage returns how much the user has stored along with
+	// their storage quota.
+	Usage(userID uint) (*StorageUsage, error)
+	// SetQuota overrides the default quota for the user. A
+	// quota of 0 goes back to the default, and a negative quota
+	// lets the user store as much as they like. Usage the user
+	// already has is kept even if it is over the new quota.
+	SetQuota(userID uint, quota int64) error
+	// Delete moves the image to the trash. It keeps counting
+	// towards the user's storage until it is purged.
+	Delete(image *Image) error
+	// Deleted returns the user's images that are in the trash,
+	// most recently deleted first.
+	Deleted(userID uint) ([]Image, error)
+	// DeletedByID returns the image in the trash with the given
+	// ID, or ErrNotFound.
+	DeletedByID(id uint) (*Image, error)
+	// DeletedBefore returns the images that were moved to the
+	// trash before t.
+	DeletedBefore(t time.Time) ([]Image, error)
+	// Restore takes the image out of the trash, renaming it if
+	// another image in its gallery took its filename since.
+	Restore(image *Image) error
+	// Purge will remove the image record for good, whether or
+	// not it is in the trash, and release the image data in
+	// storage. The data, including all of its variants, is only
+	// removed once no other image uses it.
+	Purge(image *Image) error
+	// Open returns the data of the named variant of the image,
+	// or of the original image when variant is empty or the
+	// image is still Processing. If the data can't be found
+	// ErrNotFound is returned.
+	Open(image *Image, variant string) (io.ReadCloser, error)
+	// URL returns a URL the named variant of the image can be
+	// downloaded from directly, or an empty string if it has to
+	// be served by our application. Like Open it falls back to
+	// the original while the image is Processing.
+	URL(image *Image, variant string) string
+	// Resize returns the original image resized as described
+	// by ro. ErrResizeInvalid is returned if the size isn't one
+	// of the configured ResizeSizes.
+	Resize(image *Image, ro ResizeOptions) (io.ReadCloser, error)
+	// Watermarked returns the named variant of the image, or
+	// the original when variant is empty, with the gallery's
+	// watermark drawn on it. If ro isn't nil the original is
+	// resized first, as Resize would.
+	Watermarked(image *Image, gallery *Gallery, variant string, ro *ResizeOptions) (io.ReadCloser, error)
+	// StoreWatermark stores a PNG watermark for the gallery and
+	// returns the key to set as its WatermarkKey. If the data
+	// isn't a PNG we accept ErrWatermarkFormat is returned.
+	StoreWatermark(galleryID uint, r io.Reader) (string, error)
+	// DeleteWatermark removes a watermark stored by
+	// StoreWatermark once no gallery uses it any more.
+	DeleteWatermark(key string) error
+	// ClearWatermarks drops the cached watermarked images of the
+	// gallery. Call it whenever its watermark settings change.
+	ClearWatermarks(galleryID uint) error
+	// VerifyURL checks the signature of a request for the URL
+	// path p, as built by Image.Path or one of the variant path
+	// methods. ErrURLSignatureInvalid or ErrURLExpired is
+	// returned if the request shouldn't be served.
+	VerifyURL(p string, query url.Values) error
 }
 
-func NewImageService() ImageService {
-	return &imageService{}
+// ImageDB is used to interact with the images database.
+//
+// For single image queries:
+// If the image is found, we will return a nil err
+// If the image is not found, we will return ErrNotFound
+// If there is another error, we will return an error with
+// more information about what went wrong.
+type ImageDB interface {
+	ByID(id uint) (*Image, error)
+	ByGalleryID(galleryID uint) ([]Image, error)
+	ByFilename(galleryID uint, filename string) (*Image, error)
+	ByIDs(ids []uint) ([]Image, error)
+	Search(userID uint, query string) ([]Image, error)
+	// FirstByGalleryIDs returns the first image, by position, of
+	// each of the galleries. Galleries without images are
+	// skipped.
+	FirstByGalleryIDs(galleryIDs []uint) ([]Image, error)
+	Create(image *Image) error
+	Update(image *Image) error
+	// UpdatePositions sets the Position of each image to its
+	// index in ids.
+	UpdatePositions(galleryID uint, ids []uint) error
+	// Move saves the image's new GalleryID and Filename, putting
+	// it at the end of its new gallery and clearing it as the
+	// cover of its old one.
+	Move(image *Image) error
+	// Delete moves the image to the trash, clearing it as the
+	// cover of its gallery.
+	Delete(id uint) error
+	// AllByGalleryID is like ByGalleryID, but includes the
+	// images in the trash.
+	AllByGalleryID(galleryID uint) ([]Image, error)
+	Deleted(userID uint) ([]Image, error)
+	DeletedByID(id uint) (*Image, error)
+	DeletedBefore(t time.Time) ([]Image, error)
+	// Restore takes the image out of the trash, saving its
+	// Filename in case it had to be renamed.
+	Restore(image *Image) error
+	// Purge removes the image record for good.
+	Purge(id uint) error
+	// SetProcessing marks the image as Processing.
+	SetProcessing(id uint) error
+	// SetProcessed clears Processing on every image using the
+	// blob with the given digest, including those in the trash.
+	SetProcessed(digest string) error
 }
 
-type imageService struct{}
+func NewImageService(db *gorm.DB, cfg ImageConfig) ImageService {
+	if cfg.Storage == nil {
+		cfg.Storage = NewLocalStorage("images")
+	}
+	if cfg.MaxBytes <= 0 {
+		cfg.MaxBytes = DefaultMaxImageBytes
+	}
+	if cfg.MaxWidth <= 0 {
+		cfg.MaxWidth = DefaultMaxImageDimension
+	}
+	if cfg.MaxHeight <= 0 {
+		cfg.MaxHeight = DefaultMaxImageDimension
+	}
+	if cfg.Collision == "" {
+		cfg.Collision = CollisionRename
+	}
+	if len(cfg.ResizeSizes) == 0 {
+		cfg.ResizeSizes = DefaultResizeSizes
+	}
+	var idb ImageDB = &imageValidator{
+		ImageDB: &imageGorm{
+			db: db,
+		},
+	}
+	if cfg.Signer != nil {
+		idb = &imageURLSigner{
+			ImageDB: idb,
+			signer:  cfg.Signer,
+		}
+	}
+	return &imageService{
+		ImageDB: idb,
+		blobs:   &blobGorm{db: db},
+		usage:   &usageGorm{db: db},
+		orphans: &orphanGorm{db: db},
+		jobs:    NewJobService(db),
+		cfg:     cfg,
+		store:   cfg.Storage,
+	}
+}
 
-func (is *imageService) Create(galleryID uint,
-	r io.Reader, filename string) error {
-	path, err := is.mkImagePath(galleryID)
+type imageService struct {
+	ImageDB
+	blobs   blobDB
+	usage   usageDB
+	orphans orphanDB
+	jobs    JobService
+	cfg     ImageConfig
+	store   Storage
+	resizes flightGroup
+}
+
+type imageValidator struct {
+	ImageDB
+}
+
+type imageGorm struct {
+	db *gorm.DB
+}
+
+type imageValFn func(*Image) error
+
+func (is *imageService) Create(image *Image, r io.Reader) error {
+	filename, err := sanitizeFilename(image.Filename)
+	if err != nil {
+		return err
+	}
+	image.Filename = filename
+	existing, err := is.resolveCollision(image)
 	if err != nil {
 		return err
 	}
-	// Create a destination file
-	dst, err := os.Create(filepath.Join(path, filename))
+	// Read and validate the data before anything is written to
+	// storage so rejected uploads never leave files behind.
+	data, err := is.readImageData(image, r)
 	if err != nil {
 		return err
 	}
-	defer dst.Close()
-	// Copy reader data to the destination file
-	_, err = io.Copy(dst, r)
+	data, err = processExif(image, data)
 	if err != nil {
 		return err
 	}
+	image.Size = int64(len(data))
+	if err := describeImage(image, data); err != nil {
+		return err
+	}
+	if err := is.reserveStorage(image, existing); err != nil {
+		return err
+	}
+	if err := is.storeBlob(image, data); err != nil {
+		is.releaseStorage(image, existing)
+		return err
+	}
+	image.Processing = true
+
+	if existing != nil {
+		// The image is being replaced, so we update the existing
+		// record rather than creating a second one.
+		image.Model = existing.Model
+		image.Position = existing.Position
+		err = is.ImageDB.Update(image)
+	} else {
+		err = is.ImageDB.Create(image)
+	}
+	if err != nil {
+		// Without a record nothing would refer to the data, so
+		// we release it again to keep storage and the table in
+		// sync.
+		is.releaseBlob(image.Digest)
+		is.releaseStorage(image, existing)
+		return err
+	}
+	if err := is.queueVariants(image, data); err != nil {
+		return err
+	}
+	if existing != nil {
+		if existing.UserID != image.UserID {
+			is.usage.Release(existing.UserID, existing.Size)
+		}
+		return is.removeFiles(existing)
+	}
 	return nil
 }
 
-func (is *imageService) mkImagePath(galleryID uint) (string, error) {
-	galleryPath := is.imagePath(galleryID)
-	err := os.MkdirAll(galleryPath, 0755)
+func (is *imageService) SetCovers(galleries []Gallery) error {
+	var coverIDs, galleryIDs []uint
+	for _, g := range galleries {
+		if g.CoverImageID > 0 {
+			coverIDs = append(coverIDs, g.CoverImageID)
+		}
+		galleryIDs = append(galleryIDs, g.ID)
+	}
+	covers, err := is.ByIDs(coverIDs)
+	if err != nil {
+		return err
+	}
+	byID := make(map[uint]*Image, len(covers))
+	for i := range covers {
+		byID[covers[i].ID] = &covers[i]
+	}
+	firsts, err := is.FirstByGalleryIDs(galleryIDs)
 	if err != nil {
-		return "", err
+		return err
+	}
+	byGallery := make(map[uint]*Image, len(firsts))
+	for i := range firsts {
+		byGallery[firsts[i].GalleryID] = &firsts[i]
 	}
-	return galleryPath, nil
+	for i := range galleries {
+		g := &galleries[i]
+		if cover, ok := byID[g.CoverImageID]; ok && cover.GalleryID == g.ID {
+			g.Cover = cover
+			continue
+		}
+		g.Cover = byGallery[g.ID]
+	}
+	return nil
 }
 
-func (is *imageService) ByGalleryID(galleryID uint) ([]Image, error) {
-	path := is.imagePath(galleryID)
-	strings, err := filepath.Glob(filepath.Join(path, "*"))
+func (is *imageService) Reorder(galleryID uint, ids []uint) error {
+	images, err := is.ByGalleryID(galleryID)
 	if err != nil {
-		return nil, err
+		return err
+	}
+	if len(ids) != len(images) {
+		return ErrImageOrderInvalid
 	}
-	// Setup the Image slice we are returning
-	ret := make([]Image, len(strings))
-	for i, imgStr := range strings {
-		ret[i] = Image{
-			GalleryID: galleryID,
-			Filename:  filepath.Base(imgStr),
+	remaining := make(map[uint]bool, len(images))
+	for _, image := range images {
+		remaining[image.ID] = true
+	}
+	for _, id := range ids {
+		if !remaining[id] {
+			return ErrImageOrderInvalid
 		}
+		delete(remaining, id)
+	}
+	return is.UpdatePositions(galleryID, ids)
+}
+
+func (is *imageService) Delete(i *Image) error {
+	return is.ImageDB.Delete(i.ID)
+}
+
+func (is *imageService) Restore(i *Image) error {
+	if err := is.renameToFree(i); err != nil {
+		return err
+	}
+	return is.ImageDB.Restore(i)
+}
+
+func (is *imageService) Purge(i *Image) error {
+	// The record is removed first so that a failure to remove
+	// the file leaves an orphaned file rather than a record
+	// pointing at nothing.
+	if err := is.ImageDB.Purge(i.ID); err != nil {
+		return err
 	}
-	return ret, nil
+	if err := is.usage.Release(i.UserID, i.Size); err != nil {
+		return err
+	}
+	return is.removeFiles(i)
 }
 
-// Going to need this whe we know it is already made
-func (is *imageService) imagePath(galleryID uint) string {
-	return filepath.Join("images", "galleries", fmt.Sprintf("%v", galleryID))
+// removeFiles releases the data behind the image, which
+// removes it and all of its variants from storage once no
+// other image refers to it. Images stored before we started
+// using blobs have their files removed directly.
+func (is *imageService) removeFiles(i *Image) error {
+	if i.Digest != "" {
+		return is.releaseBlob(i.Digest)
+	}
+	key, err := i.key()
+	if err != nil {
+		return err
+	}
+	if err := is.store.Delete(key); err != nil {
+		return err
+	}
+	return is.removeVariants(i)
+}
+
+// Open returns the data of the named variant of the image.
+// The original is returned when variant is empty.
+func (is *imageService) Open(i *Image, variant string) (io.ReadCloser, error) {
+	if i.Processing {
+		variant = ""
+	}
+	key, err := i.variantKey(variant)
+	if err != nil {
+		return nil, err
+	}
+	return is.store.Get(key)
+}
+
+// URL returns a URL the named variant of the image can be
+// downloaded from directly, if our storage offers one.
+func (is *imageService) URL(i *Image, variant string) string {
+	if i.Processing {
+		variant = ""
+	}
+	key, err := i.variantKey(variant)
+	if err != nil {
+		return ""
+	}
+	return is.store.URL(key)
+}
+
+func (is *imageService) VerifyURL(p string, query url.Values) error {
+	if is.cfg.Signer == nil {
+		return nil
+	}
+	return is.cfg.Signer.Verify(p, query)
+}
+
+// Alt returns the text to use for the image's alt attribute,
+// falling back to its title when no alt text was given.
+func (i *Image) Alt() string {
+	if i.AltText != "" {
+		return i.AltText
+	}
+	return i.Title
 }
 
 // Path is used to build the absolute path used to reference this image
 // via a web request.
 func (i *Image) Path() string {
+	return i.urlPath(imageURLPath(galleryKey(i.GalleryID, i.Filename)))
+}
+
+// Version identifies the data of the image. It changes
+// whenever the image is replaced, so it is added to the image
+// URLs to let browsers cache them for as long as they like.
+// Images stored before we started using blobs don't have one.
+func (i *Image) Version() string {
+	if len(i.Digest) < 16 {
+		return ""
+	}
+	return i.Digest[:16]
+}
+
+// urlPath adds the version of the image to the URL path p and
+// signs it if needed.
+func (i *Image) urlPath(p string) string {
+	q := url.Values{}
+	if v := i.Version(); v != "" {
+		q.Set("v", v)
+	}
+	if i.slug != "" {
+		q.Set("g", i.slug)
+	}
+	if len(q) > 0 {
+		p += "?" + q.Encode()
+	}
+	return i.signedPath(p)
+}
+
+// SetGallerySlug adds the slug of the unlisted gallery the
+// image is in to its paths, which lets anybody who saw the
+// gallery at its slug load the image. The paths stop working
+// once the gallery isn't unlisted anymore, since that clears
+// its slug.
+func (i *Image) SetGallerySlug(slug string) {
+	i.slug = slug
+}
+
+// GallerySlug returns the slug in the query of an image path,
+// see SetGallerySlug.
+func GallerySlug(query url.Values) string {
+	return query.Get("g")
+}
+
+// key is the storage key of the original image.
+func (i *Image) key() (string, error) {
+	return i.variantKey("")
+}
+
+// galleryDir is the storage key prefix of every image stored
+// in the gallery.
+func galleryDir(galleryID uint) string {
+	return fmt.Sprintf("galleries/%v", galleryID)
+}
+
+func galleryKey(galleryID uint, filename string) string {
+	return path.Join(galleryDir(galleryID), filename)
+}
+
+// imageURLPath is used to build the path our application
+// serves the data stored under key from.
+func imageURLPath(key string) string {
 	temp := url.URL{
-		Path: "/" + i.RelativePath(),
+		Path: "/images/" + key,
 	}
 	return temp.String()
 }
 
-// RelativePath is used to build the path to this image on our local
-// disk, relative to where our Go application is run from.
-func (i *Image) RelativePath() string {
-	// Convert the gallery ID to a string
-	galleryID := fmt.Sprintf("%v", i.GalleryID)
-	return filepath.ToSlash(filepath.Join("images", "galleries", galleryID, i.Filename))
+func runImageValFns(image *Image, fns ...imageValFn) error {
+	for _, fn := range fns {
+		if err := fn(image); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (iv *imageValidator) galleryIDRequired(i *Image) error {
+	if i.GalleryID <= 0 {
+		return ErrGalleryIDRequired
+	}
+	return nil
 }
 
-func (is *imageService) Delete(i *Image) error {
-	return os.Remove(i.RelativePath())
+func (iv *imageValidator) userIDRequired(i *Image) error {
+	if i.UserID <= 0 {
+		return ErrUserIDRequired
+	}
+	return nil
+}
+
+func (iv *imageValidator) filenameRequired(i *Image) error {
+	if i.Filename == "" {
+		return ErrFilenameRequired
+	}
+	return nil
+}
+
+func (iv *imageValidator) normalizeFilename(i *Image) error {
+	filename, err := sanitizeFilename(i.Filename)
+	if err != nil {
+		return err
+	}
+	i.Filename = filename
+	return nil
+}
+
+func (iv *imageValidator) normalizeText(i *Image) error {
+	i.Title = strings.TrimSpace(i.Title)
+	i.Caption = strings.TrimSpace(i.Caption)
+	i.AltText = strings.TrimSpace(i.AltText)
+	return nil
+}
+
+func (iv *imageValidator) textMaxLength(i *Image) error {
+	if utf8.RuneCountInString(i.Title) > maxImageTextLength ||
+		utf8.RuneCountInString(i.AltText) > maxImageTextLength {
+		return ErrImageTextTooLong
+	}
+	if utf8.RuneCountInString(i.Caption) > maxCaptionLength {
+		return ErrCaptionTooLong
+	}
+	return nil
+}
+
+func (iv *imageValidator) nonZeroID(i *Image) error {
+	if i.ID <= 0 {
+		return ErrIDInvalid
+	}
+	return nil
+}
+
+func (iv *imageValidator) Create(image *Image) error {
+	err := runImageValFns(image,
+		iv.galleryIDRequired,
+		iv.userIDRequired,
+		iv.filenameRequired,
+		iv.normalizeFilename,
+		iv.normalizeText,
+		iv.textMaxLength)
+	if err != nil {
+		return err
+	}
+	return iv.ImageDB.Create(image)
+}
+
+func (iv *imageValidator) Update(image *Image) error {
+	err := runImageValFns(image,
+		iv.nonZeroID,
+		iv.galleryIDRequired,
+		iv.userIDRequired,
+		iv.filenameRequired,
+		iv.normalizeFilename,
+		iv.normalizeText,
+		iv.textMaxLength)
+	if err != nil {
+		return err
+	}
+	return iv.ImageDB.Update(image)
+}
+
+// ByFilename will normalize the filename before passing it
+// on to the database layer, so any filename that could never
+// have been stored is rejected with ErrFilenameInvalid.
+func (iv *imageValidator) ByFilename(galleryID uint, filename string) (*Image, error) {
+	image := Image{
+		GalleryID: galleryID,
+		Filename:  filename,
+	}
+	err := runImageValFns(&image,
+		iv.filenameRequired,
+		iv.normalizeFilename)
+	if err != nil {
+		return nil, err
+	}
+	return iv.ImageDB.ByFilename(image.GalleryID, image.Filename)
+}
+
+func (iv *imageValidator) Move(image *Image) error {
+	err := runImageValFns(image,
+		iv.nonZeroID,
+		iv.galleryIDRequired,
+		iv.filenameRequired,
+		iv.normalizeFilename)
+	if err != nil {
+		return err
+	}
+	return iv.ImageDB.Move(image)
+}
+
+func (iv *imageValidator) Delete(id uint) error {
+	var image Image
+	image.ID = id
+	if err := runImageValFns(&image, iv.nonZeroID); err != nil {
+		return err
+	}
+	return iv.ImageDB.Delete(image.ID)
+}
+
+func (iv *imageValidator) Restore(image *Image) error {
+	err := runImageValFns(image,
+		iv.nonZeroID,
+		iv.filenameRequired,
+		iv.normalizeFilename)
+	if err != nil {
+		return err
+	}
+	return iv.ImageDB.Restore(image)
+}
+
+func (iv *imageValidator) Purge(id uint) error {
+	var image Image
+	image.ID = id
+	if err := runImageValFns(&image, iv.nonZeroID); err != nil {
+		return err
+	}
+	return iv.ImageDB.Purge(image.ID)
+}
+
+func (ig *imageGorm) ByID(id uint) (*Image, error) {
+	var image Image
+	db := ig.db.Where("id = ?", id)
+	err := first(db, &image)
+	if err != nil {
+		return nil, err
+	}
+	return &image, nil
+}
+
+func (ig *imageGorm) ByGalleryID(galleryID uint) ([]Image, error) {
+	var images []Image
+	db := ig.db.Where("gallery_id = ?", galleryID).Order("position, id")
+	if err := db.Find(&images).Error; err != nil {
+		return nil, err
+	}
+	return images, nil
+}
+
+func (ig *imageGorm) ByIDs(ids []uint) ([]Image, error) {
+	var images []Image
+	if len(ids) == 0 {
+		return images, nil
+	}
+	if err := ig.db.Where("id IN (?)", ids).Find(&images).Error; err != nil {
+		return nil, err
+	}
+	return images, nil
+}
+
+func (ig *imageGorm) Search(userID uint, query string) ([]Image, error) {
+	var images []Image
+	// Escape the LIKE wildcards so they are matched literally.
+	pattern := "%" + likeEscaper.Replace(query) + "%"
+	db := ig.db.Where("user_id = ?", userID).
+		Where("title ILIKE ? OR caption ILIKE ? OR alt_text ILIKE ?",
+			pattern, pattern, pattern).
+		// Images in a gallery that is in the trash are hidden
+		// along with it.
+		Where("gallery_id IN (?)", ig.db.Table("galleries").
+			Where("deleted_at IS NULL").Select("id").QueryExpr()).
+		Order("gallery_id, position, id")
+	if err := db.Find(&images).Error; err != nil {
+		return nil, err
+	}
+	return images, nil
+}
+
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+func (ig *imageGorm) FirstByGalleryIDs(galleryIDs []uint) ([]Image, error) {
+	var images []Image
+	if len(galleryIDs) == 0 {
+		return images, nil
+	}
+	db := ig.db.Select("DISTINCT ON (gallery_id) *").
+		Where("gallery_id IN (?)", galleryIDs).
+		Order("gallery_id, position, id")
+	if err := db.Find(&images).Error; err != nil {
+		return nil, err
+	}
+	return images, nil
+}
+
+func (ig *imageGorm) ByFilename(galleryID uint, filename string) (*Image, error) {
+	var image Image
+	db := ig.db.Where("gallery_id = ? AND filename = ?", galleryID, filename)
+	err := first(db, &image)
+	if err != nil {
+		return nil, err
+	}
+	return &image, nil
+}
+
+// Create will add the image to the end of its gallery unless
+// it already has a position.
+func (ig *imageGorm) Create(image *Image) error {
+	if image.Position == 0 {
+		row := ig.db.Model(&Image{}).
+			Where("gallery_id = ?", image.GalleryID).
+			Select("COALESCE(MAX(position), 0)").Row()
+		var max int
+		if err := row.Scan(&max); err != nil {
+			return err
+		}
+		image.Position = max + 1
+	}
+	return ig.db.Create(image).Error
+}
+
+func (ig *imageGorm) UpdatePositions(galleryID uint, ids []uint) error {
+	tx := ig.db.Begin()
+	if tx.Error != nil {
+		return tx.Error
+	}
+	for i, id := range ids {
+		err := tx.Model(&Image{}).
+			Where("id = ? AND gallery_id = ?", id, galleryID).
+			UpdateColumn("position", i+1).Error
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit().Error
+}
+
+// Update saves the image, except for Processing. That is only
+// changed by SetProcessing and SetProcessed, so saving an image
+// loaded before its variants were done can't undo them.
+func (ig *imageGorm) Update(image *Image) error {
+	return ig.db.Omit("processing").Save(image).Error
+}
+
+// Delete moves the image record to the trash, keeping its data
+// around in case it is restored. Any gallery using the image as
+// its cover is cleared so it falls back to its first image.
+func (ig *imageGorm) Delete(id uint) error {
+	tx := ig.db.Begin()
+	if tx.Error != nil {
+		return tx.Error
+	}
+	err := tx.Model(&Gallery{}).
+		Where("cover_image_id = ?", id).
+		UpdateColumn("cover_image_id", 0).Error
+	if err == nil {
+		image := Image{Model: gorm.Model{ID: id}}
+		err = tx.Delete(&image).Error
+	}
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit().Error
+}
+
+func (ig *imageGorm) AllByGalleryID(galleryID uint) ([]Image, error) {
+	var images []Image
+	db := ig.db.Unscoped().Where("gallery_id = ?", galleryID)
+	if err := db.Find(&images).Error; err != nil {
+		return nil, err
+	}
+	return images, nil
+}
+
+func (ig *imageGorm) Deleted(userID uint) ([]Image, error) {
+	var images []Image
+	db := ig.db.Unscoped().
+		Where("user_id = ? AND deleted_at IS NOT NULL", userID).
+		Order("deleted_at DESC")
+	if err := db.Find(&images).Error; err != nil {
+		return nil, err
+	}
+	return images, nil
+}
+
+func (ig *imageGorm) DeletedByID(id uint) (*Image, error) {
+	var image Image
+	db := ig.db.Unscoped().Where("id = ? AND deleted_at IS NOT NULL", id)
+	err := first(db, &image)
+	if err != nil {
+		return nil, err
+	}
+	return &image, nil
+}
+
+func (ig *imageGorm) DeletedBefore(t time.Time) ([]Image, error) {
+	var images []Image
+	db := ig.db.Unscoped().
+		Where("deleted_at IS NOT NULL AND deleted_at < ?", t)
+	if err := db.Find(&images).Error; err != nil {
+		return nil, err
+	}
+	return images, nil
+}
+
+func (ig *imageGorm) Restore(image *Image) error {
+	err := ig.db.Unscoped().Model(&Image{}).Where("id = ?", image.ID).
+		UpdateColumns(map[string]interface{}{
+			"deleted_at": nil,
+			"filename":   image.Filename,
+		}).Error
+	if err != nil {
+		return err
+	}
+	image.DeletedAt = nil
+	return nil
+}
+
+func (ig *imageGorm) SetProcessing(id uint) error {
+	return ig.db.Unscoped().Model(&Image{}).Where("id = ?", id).
+		UpdateColumn("processing", true).Error
+}
+
+func (ig *imageGorm) SetProcessed(digest string) error {
+	return ig.db.Unscoped().Model(&Image{}).Where("digest = ?", digest).
+		UpdateColumn("processing", false).Error
+}
+
+func (ig *imageGorm) Purge(id uint) error {
+	tx := ig.db.Begin()
+	if tx.Error != nil {
+		return tx.Error
+	}
+	err := tx.Model(&Gallery{}).
+		Where("cover_image_id = ?", id).
+		UpdateColumn("cover_image_id", 0).Error
+	if err == nil {
+		image := Image{Model: gorm.Model{ID: id}}
+		err = tx.Unscoped().Delete(&image).Error
+	}
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit().Error
 }
@@ -0,0 +1,281 @@
+package models
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// The states a Job goes through. A job is queued until a
+// worker claims it, and running until the worker is done with
+// it. Jobs that fail are queued again with a growing delay,
+// until they run out of attempts and are left dead.
+const (
+	JobQueued  = "queued"
+	JobRunning = "running"
+	JobDone    = "done"
+	JobDead    = "dead"
+)
+
+const (
+	// DefaultJobAttempts is how many times a job is run before
+	// it is given up on, unless the job says otherwise.
+	DefaultJobAttempts = 5
+
+	// jobTimeout is how long a job may run before we assume
+	// the worker running it died, and let another worker have
+	// it.
+	jobTimeout = 10 * time.Minute
+	// jobBackoff is how long we wait before retrying a job
+	// that failed for the first time. The wait doubles with
+	// every attempt, up to maxJobBackoff.
+	jobBackoff    = 10 * time.Second
+	maxJobBackoff = time.Hour
+
+	ErrJobKindRequired modelError = "models: job kind is required"
+)
+
+// Job is a piece of work that is done in the background
+// rather than while the user waits, such as creating the
+// variants of an uploaded image. Jobs are kept in the jobs
+// table so they survive restarts, and any number of servers
+// can work on them at once.
+type Job struct {
+	ID uint `gorm:"primary_key"`
+	// Kind decides which JobHandler runs the job.
+	Kind string `gorm:"not_null"`
+	// Payload is the JSON encoded input of the job. Use Encode
+	// and Decode rather than setting it directly.
+	Payload string `gorm:"type:text"`
+	// GalleryID and ImageID are what the job is working on, if
+	// anything, so its progress can be shown to the user.
+	GalleryID   uint   `gorm:"index"`
+	ImageID     uint   `gorm:"index"`
+	Status      string `gorm:"not_null;default:'queued';index"`
+	Attempts    int    `gorm:"not_null;default:0"`
+	MaxAttempts int    `gorm:"not_null;default:0"`
+	// RunAt is when the job should run next.
+	RunAt time.Time `gorm:"not_null;index"`
+	// LockedAt is when the job was last claimed by a worker.
+	LockedAt  *time.Time
+	LastError string `gorm:"type:text"`
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
+
+// Encode sets the job's payload to v encoded as JSON.
+func (j *Job) Encode(v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	j.Payload = string(b)
+	return nil
+}
+
+// Decode decodes the job's payload into v.
+func (j *Job) Decode(v interface{}) error {
+	return json.Unmarshal([]byte(j.Payload), v)
+}
+
+// Pending reports whether the job still has to run, whether or
+// not it failed before.
+func (j *Job) Pending() bool {
+	return j.Status == JobQueued || j.Status == JobRunning
+}
+
+// Dead reports whether the job failed too often to be retried.
+func (j *Job) Dead() bool {
+	return j.Status == JobDead
+}
+
+// JobService is used to queue jobs and keep track of them.
+type JobService interface {
+	JobDB
+	// Complete marks a job claimed by a worker as done.
+	Complete(job *Job) error
+	// Fail records why a job claimed by a worker failed. The job
+	// is retried later, waiting longer after every attempt,
+	// unless it has no attempts left in which case it is left
+	// dead.
+	Fail(job *Job, err error) error
+}
+
+// JobDB is used to interact with the jobs table.
+//
+// For single job queries:
+// If the job is found, we will return a nil err
+// If the job is not found, we will return ErrNotFound
+// If there is another error, we will return an error with
+// more information about what went wrong.
+type JobDB interface {
+	ByID(id uint) (*Job, error)
+	// ByGalleryID returns the jobs working on the gallery or its
+	// images that aren't done yet, including dead ones.
+	ByGalleryID(galleryID uint) ([]Job, error)
+	// Enqueue adds the job to the queue. Jobs without a RunAt
+	// run as soon as a worker is free.
+	Enqueue(job *Job) error
+	// Claim hands out the next job that is due, marking it as
+	// running, or returns ErrNotFound if there is none. No two
+	// workers are ever handed the same job, but a job that has
+	// been running for too long is handed out again.
+	Claim() (*Job, error)
+	Update(job *Job) error
+	// RemoveDone removes the jobs that were done before t.
+	RemoveDone(t time.Time) error
+}
+
+func NewJobService(db *gorm.DB) JobService {
+	return &jobService{
+		JobDB: &jobValidator{
+			JobDB: &jobGorm{
+				db: db,
+			},
+		},
+	}
+}
+
+type jobService struct {
+	JobDB
+}
+
+type jobValidator struct {
+	JobDB
+}
+
+type jobGorm struct {
+	db *gorm.DB
+}
+
+type jobValFn func(*Job) error
+
+func (js *jobService) Complete(job *Job) error {
+	job.Status = JobDone
+	job.LockedAt = nil
+	job.LastError = ""
+	return js.Update(job)
+}
+
+func (js *jobService) Fail(job *Job, err error) error {
+	job.LockedAt = nil
+	job.LastError = err.Error()
+	if job.Attempts >= job.MaxAttempts {
+		job.Status = JobDead
+		return js.Update(job)
+	}
+	job.Status = JobQueued
+	job.RunAt = time.Now().Add(jobRetryDelay(job.Attempts))
+	return js.Update(job)
+}
+
+// jobRetryDelay is how long to wait before running a job again
+// after it failed attempts times.
+func jobRetryDelay(attempts int) time.Duration {
+	delay := jobBackoff
+	for i := 1; i < attempts && delay < maxJobBackoff; i++ {
+		delay *= 2
+	}
+	if delay > maxJobBackoff {
+		delay = maxJobBackoff
+	}
+	return delay
+}
+
+func runJobValFns(job *Job, fns ...jobValFn) error {
+	for _, fn := range fns {
+		if err := fn(job); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (jv *jobValidator) Enqueue(job *Job) error {
+	err := runJobValFns(job,
+		jv.kindRequired,
+		jv.setDefaults)
+	if err != nil {
+		return err
+	}
+	return jv.JobDB.Enqueue(job)
+}
+
+func (jv *jobValidator) kindRequired(j *Job) error {
+	if j.Kind == "" {
+		return ErrJobKindRequired
+	}
+	return nil
+}
+
+func (jv *jobValidator) setDefaults(j *Job) error {
+	j.Status = JobQueued
+	j.Attempts = 0
+	if j.MaxAttempts <= 0 {
+		j.MaxAttempts = DefaultJobAttempts
+	}
+	if j.RunAt.IsZero() {
+		j.RunAt = time.Now()
+	}
+	return nil
+}
+
+func (jg *jobGorm) ByID(id uint) (*Job, error) {
+	var job Job
+	db := jg.db.Where("id = ?", id)
+	err := first(db, &job)
+	if err != nil {
+		return nil, err
+	}
+	return &job, nil
+}
+
+func (jg *jobGorm) ByGalleryID(galleryID uint) ([]Job, error) {
+	var jobs []Job
+	db := jg.db.Where("gallery_id = ? AND status <> ?", galleryID, JobDone).
+		Order("id")
+	if err := db.Find(&jobs).Error; err != nil {
+		return nil, err
+	}
+	return jobs, nil
+}
+
+func (jg *jobGorm) Enqueue(job *Job) error {
+	return jg.db.Create(job).Error
+}
+
+func (jg *jobGorm) Claim() (*Job, error) {
+	now := time.Now()
+	var job Job
+	// SKIP LOCKED lets every worker grab a different job
+	// without waiting on each other.
+	err := jg.db.Raw(`UPDATE jobs
+		SET status = ?, attempts = attempts + 1, locked_at = ?, updated_at = ?
+		WHERE id = (
+			SELECT id FROM jobs
+			WHERE (status = ? AND run_at <= ?) OR (status = ? AND locked_at < ?)
+			ORDER BY run_at, id
+			LIMIT 1
+			FOR UPDATE SKIP LOCKED)
+		RETURNING *`,
+		JobRunning, now, now,
+		JobQueued, now, JobRunning, now.Add(-jobTimeout)).
+		Scan(&job).Error
+	if err == gorm.ErrRecordNotFound {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &job, nil
+}
+
+func (jg *jobGorm) Update(job *Job) error {
+	return jg.db.Save(job).Error
+}
+
+func (jg *jobGorm) RemoveDone(t time.Time) error {
+	return jg.db.Where("status = ? AND updated_at < ?", JobDone, t).
+		Delete(&Job{}).Error
+}
@@ -0,0 +1,121 @@
+package models
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+
+	"golang.org/x/image/draw"
+)
+
+const (
+	// placeholderSize is the size of the box the placeholder of
+	// an image is scaled down to fit in. Browsers stretch it to
+	// the size of the image, which blurs it nicely.
+	placeholderSize    = 16
+	placeholderQuality = 40
+	// colorSampleSize is the size of the box an image is scaled
+	// down to before looking for its dominant color, which is
+	// plenty and keeps it cheap for large photos.
+	colorSampleSize = 64
+)
+
+// describeImage sets the Width, Height, Color and Placeholder
+// of the image from its data. The data must already be upright,
+// see processExif, so the dimensions are the ones it is shown
+// with.
+func describeImage(i *Image, data []byte) error {
+	src, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		// The header was checked by readImageData, so the rest
+		// of the data must be broken.
+		return ErrImageFormat
+	}
+	b := src.Bounds()
+	i.Width, i.Height = b.Dx(), b.Dy()
+	c := dominantColor(src)
+	i.Color = fmt.Sprintf("#%02x%02x%02x", c.R, c.G, c.B)
+	i.Placeholder = ""
+	// Once a transparent image is loaded the placeholder would
+	// show through it, so those only get the color.
+	if o, ok := src.(interface{ Opaque() bool }); ok && !o.Opaque() {
+		return nil
+	}
+	placeholder, err := placeholderURI(src, c)
+	if err != nil {
+		return err
+	}
+	i.Placeholder = placeholder
+	return nil
+}
+
+// dominantColor returns the most common color of the image.
+// Colors are grouped into buckets first, since photos rarely
+// have two pixels that are exactly the same, and the pixels in
+// the biggest bucket are averaged. Transparent pixels are
+// ignored.
+func dominantColor(src image.Image) color.RGBA {
+	sample := resize(src, colorSampleSize)
+	type bucket struct {
+		r, g, b, n int
+	}
+	var buckets [4096]bucket
+	best := -1
+	b := sample.Bounds()
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			c := color.NRGBAModel.Convert(sample.At(x, y)).(color.NRGBA)
+			if c.A < 128 {
+				continue
+			}
+			k := int(c.R>>4)<<8 | int(c.G>>4)<<4 | int(c.B>>4)
+			bk := &buckets[k]
+			bk.r += int(c.R)
+			bk.g += int(c.G)
+			bk.b += int(c.B)
+			bk.n++
+			if best < 0 || bk.n > buckets[best].n {
+				best = k
+			}
+		}
+	}
+	if best < 0 {
+		// A fully transparent image doesn't really have a color,
+		// so we go with the background most pages have.
+		return color.RGBA{255, 255, 255, 255}
+	}
+	bk := buckets[best]
+	return color.RGBA{uint8(bk.r / bk.n), uint8(bk.g / bk.n), uint8(bk.b / bk.n), 255}
+}
+
+// placeholderURI returns a tiny JPEG copy of the image as a
+// data URI that can be inlined in a page. Anything transparent
+// is drawn over bg.
+func placeholderURI(src image.Image, bg color.RGBA) (string, error) {
+	b := src.Bounds()
+	w, h := placeholderSize, placeholderSize
+	if b.Dx() >= b.Dy() {
+		h = b.Dy() * placeholderSize / b.Dx()
+	} else {
+		w = b.Dx() * placeholderSize / b.Dy()
+	}
+	if w < 1 {
+		w = 1
+	}
+	if h < 1 {
+		h = 1
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	draw.Draw(dst, dst.Bounds(), image.NewUniform(bg), image.Point{}, draw.Src)
+	draw.CatmullRom.Scale(dst, dst.Bounds(), src, b, draw.Over, nil)
+	var buf bytes.Buffer
+	err := jpeg.Encode(&buf, dst, &jpeg.Options{Quality: placeholderQuality})
+	if err != nil {
+		return "", err
+	}
+	return "data:image/jpeg;base64," +
+		base64.StdEncoding.EncodeToString(buf.Bytes()), nil
+}
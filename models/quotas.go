@@ -0,0 +1,192 @@
+package models
+
+import (
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+const (
+	ErrStorageQuotaExceeded modelError = "models: this upload would " +
+		"put you over your storage quota"
+)
+
+// storageUsage keeps track of how many bytes of images each
+// user has stored. Quota overrides the default quota for the
+// user: 0 uses the default and a negative quota means the user
+// can store as much as they like.
+type storageUsage struct {
+	UserID    uint  `gorm:"primary_key;auto_increment:false"`
+	Used      int64 `gorm:"not_null;default:0"`
+	Quota     int64 `gorm:"not_null;default:0"`
+	UpdatedAt time.Time
+}
+
+// StorageUsage is how much a user has stored and how much
+// they are allowed to store. A Quota of 0 means there is no
+// limit.
+type StorageUsage struct {
+	Used  int64
+	Quota int64
+}
+
+// Unlimited reports whether the user can store as much as
+// they like.
+func (su StorageUsage) Unlimited() bool {
+	return su.Quota <= 0
+}
+
+// Percent is how much of the quota has been used, from 0 to
+// 100.
+func (su StorageUsage) Percent() int {
+	if su.Unlimited() {
+		return 0
+	}
+	p := int(su.Used * 100 / su.Quota)
+	if p > 100 {
+		p = 100
+	}
+	return p
+}
+
+// UsedString and QuotaString return the usage and quota in a
+// human friendly form, eg "12.5 MB".
+func (su StorageUsage) UsedString() string {
+	return formatBytes(su.Used)
+}
+
+func (su StorageUsage) QuotaString() string {
+	return formatBytes(su.Quota)
+}
+
+func formatBytes(n int64) string {
+	const unit = 1 << 10
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %cB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+// usageDB is used to keep track of how much each user has
+// stored.
+type usageDB interface {
+	// Reserve adds n bytes to the user's usage, unless that
+	// would take them over their quota in which case
+	// ErrStorageQuotaExceeded is returned. defaultQuota is used
+	// for users without a quota of their own, and 0 means no
+	// limit. n may be negative when an image is replaced with a
+	// smaller one, which is always allowed.
+	Reserve(userID uint, n, defaultQuota int64) error
+	// Release removes n bytes from the user's usage.
+	Release(userID uint, n int64) error
+	// Usage returns the user's usage along with the quota that
+	// applies to them.
+	Usage(userID uint, defaultQuota int64) (*StorageUsage, error)
+	// SetQuota gives the user a quota of their own, see
+	// storageUsage.
+	SetQuota(userID uint, quota int64) error
+}
+
+type usageGorm struct {
+	db *gorm.DB
+}
+
+func (ug *usageGorm) ensure(userID uint) error {
+	return ug.db.Exec(`INSERT INTO storage_usages (user_id, used, quota, updated_at)
+		VALUES (?, 0, 0, ?) ON CONFLICT (user_id) DO NOTHING`,
+		userID, time.Now()).Error
+}
+
+func (ug *usageGorm) Reserve(userID uint, n, defaultQuota int64) error {
+	if err := ug.ensure(userID); err != nil {
+		return err
+	}
+	if defaultQuota <= 0 {
+		defaultQuota = math.MaxInt64
+	}
+	// Checking and updating in a single statement means two
+	// uploads at once can't both squeeze under the quota.
+	db := ug.db.Exec(`UPDATE storage_usages
+		SET used = GREATEST(used + ?, 0), updated_at = ?
+		WHERE user_id = ? AND (? <= 0 OR quota < 0 OR
+			used + ? <= CASE WHEN quota > 0 THEN quota ELSE ? END)`,
+		n, time.Now(), userID, n, n, defaultQuota)
+	if db.Error != nil {
+		return db.Error
+	}
+	if db.RowsAffected == 0 {
+		return ErrStorageQuotaExceeded
+	}
+	return nil
+}
+
+func (ug *usageGorm) Release(userID uint, n int64) error {
+	return ug.db.Exec(`UPDATE storage_usages
+		SET used = GREATEST(used - ?, 0), updated_at = ?
+		WHERE user_id = ?`, n, time.Now(), userID).Error
+}
+
+func (ug *usageGorm) SetQuota(userID uint, quota int64) error {
+	if err := ug.ensure(userID); err != nil {
+		return err
+	}
+	return ug.db.Exec(`UPDATE storage_usages SET quota = ?, updated_at = ?
+		WHERE user_id = ?`, quota, time.Now(), userID).Error
+}
+
+func (ug *usageGorm) Usage(userID uint, defaultQuota int64) (*StorageUsage, error) {
+	var su storageUsage
+	err := ug.db.Where("user_id = ?", userID).First(&su).Error
+	switch err {
+	case nil:
+	case gorm.ErrRecordNotFound:
+		// Users that never uploaded anything have no record yet.
+	default:
+		return nil, err
+	}
+	usage := StorageUsage{
+		Used:  su.Used,
+		Quota: su.Quota,
+	}
+	if su.Quota == 0 {
+		usage.Quota = defaultQuota
+	}
+	if usage.Quota < 0 {
+		usage.Quota = 0
+	}
+	return &usage, nil
+}
+
+// reserveStorage charges the user for the image, taking the
+// size of the image it replaces, if any, into account.
+func (is *imageService) reserveStorage(i, existing *Image) error {
+	n := i.Size
+	if existing != nil && existing.UserID == i.UserID {
+		n -= existing.Size
+	}
+	return is.usage.Reserve(i.UserID, n, is.cfg.DefaultQuota)
+}
+
+// releaseStorage undoes reserveStorage.
+func (is *imageService) releaseStorage(i, existing *Image) error {
+	n := i.Size
+	if existing != nil && existing.UserID == i.UserID {
+		n -= existing.Size
+	}
+	return is.usage.Release(i.UserID, n)
+}
+
+func (is *imageService) Usage(userID uint) (*StorageUsage, error) {
+	return is.usage.Usage(userID, is.cfg.DefaultQuota)
+}
+
+func (is *imageService) SetQuota(userID uint, quota int64) error {
+	return is.usage.SetQuota(userID, quota)
+}
@@ -0,0 +1,94 @@
+package models
+
+import (
+	"os"
+	"testing"
+
+	"github.com/jinzhu/gorm"
+)
+
+// testDB connects to the Postgres database in TEST_DATABASE,
+// eg "host=localhost user=postgres dbname=golang_test
+// sslmode=disable". Tests that need it are skipped without it,
+// and close it when they are done.
+func testDB(t *testing.T) *gorm.DB {
+	info := os.Getenv("TEST_DATABASE")
+	if info == "" {
+		t.Skip("TEST_DATABASE is not set")
+	}
+	db, err := gorm.Open("postgres", info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func TestUsageReserve(t *testing.T) {
+	db := testDB(t)
+	defer db.Close()
+	if err := db.AutoMigrate(&storageUsage{}).Error; err != nil {
+		t.Fatal(err)
+	}
+	ug := &usageGorm{db: db}
+	tests := []struct {
+		name         string
+		quota        int64
+		used         int64
+		defaultQuota int64
+		n            int64
+		want         error
+		wantUsed     int64
+	}{
+		{"under the default", 0, 0, 100, 50, nil, 50},
+		{"up to the default", 0, 50, 100, 50, nil, 100},
+		{"over the default", 0, 60, 100, 50, ErrStorageQuotaExceeded, 60},
+		{"no default", 0, 1 << 40, 0, 1 << 40, nil, 2 << 40},
+		{"own quota above the default", 200, 150, 100, 40, nil, 190},
+		{"own quota below the default", 50, 40, 100, 20, ErrStorageQuotaExceeded, 40},
+		{"unlimited", -1, 1 << 40, 100, 1 << 40, nil, 2 << 40},
+		{"shrinking over the quota", 0, 150, 100, -20, nil, 130},
+		{"shrinking below zero", 0, 10, 100, -20, nil, 0},
+	}
+	for i, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			userID := uint(1<<30 + i)
+			db.Where("user_id = ?", userID).Delete(&storageUsage{})
+			defer db.Where("user_id = ?", userID).Delete(&storageUsage{})
+			if err := ug.SetQuota(userID, tc.quota); err != nil {
+				t.Fatal(err)
+			}
+			err := db.Model(&storageUsage{}).Where("user_id = ?", userID).
+				Update("used", tc.used).Error
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := ug.Reserve(userID, tc.n, tc.defaultQuota); err != tc.want {
+				t.Fatalf("Reserve() = %v, want %v", err, tc.want)
+			}
+			usage, err := ug.Usage(userID, tc.defaultQuota)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if usage.Used != tc.wantUsed {
+				t.Errorf("Used = %d, want %d", usage.Used, tc.wantUsed)
+			}
+		})
+	}
+}
+
+func TestStorageUsagePercent(t *testing.T) {
+	tests := []struct {
+		usage StorageUsage
+		want  int
+	}{
+		{StorageUsage{Used: 0, Quota: 100}, 0},
+		{StorageUsage{Used: 50, Quota: 100}, 50},
+		{StorageUsage{Used: 150, Quota: 100}, 100},
+		{StorageUsage{Used: 150, Quota: 0}, 0},
+	}
+	for _, tc := range tests {
+		if got := tc.usage.Percent(); got != tc.want {
+			t.Errorf("%+v.Percent() = %d, want %d", tc.usage, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,251 @@
+package models
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/url"
+	"strconv"
+	"sync"
+
+	"golang.org/x/image/draw"
+)
+
+const (
+	// FitContain scales the image to fit inside the requested
+	// box, keeping its aspect ratio.
+	FitContain = "contain"
+	// FitCover scales the image to fill the requested box,
+	// cropping whatever sticks out around the center.
+	FitCover = "cover"
+
+	ErrResizeInvalid modelError = "models: that image size is not available"
+)
+
+// DefaultResizeSizes are the widths and heights, in pixels,
+// images can be resized to on request when the ImageConfig
+// doesn't list its own.
+var DefaultResizeSizes = []int{160, 320, 480, 640, 800, 1024, 1280, 1600, 1920}
+
+// ResizeOptions describes an image resized on request. Either
+// Width or Height may be 0 to leave that side unconstrained.
+// Images are never scaled up.
+type ResizeOptions struct {
+	Width  int
+	Height int
+	// Fit is FitContain or FitCover, defaulting to FitContain.
+	// FitCover needs both a Width and a Height.
+	Fit string
+}
+
+// ResizedPath is used to build the path to a copy of this
+// image resized on request. The size is part of the signature
+// when URLs are signed, so it can't be changed by whoever has
+// the URL.
+func (i *Image) ResizedPath(ro ResizeOptions) string {
+	p := imageURLPath(galleryKey(i.GalleryID, i.Filename))
+	q := url.Values{}
+	if v := i.Version(); v != "" {
+		q.Set("v", v)
+	}
+	if ro.Width > 0 {
+		q.Set("w", strconv.Itoa(ro.Width))
+	}
+	if ro.Height > 0 {
+		q.Set("h", strconv.Itoa(ro.Height))
+	}
+	if ro.Fit != "" {
+		q.Set("fit", ro.Fit)
+	}
+	if i.slug != "" {
+		q.Set("g", i.slug)
+	}
+	return i.signedPath(p + "?" + q.Encode())
+}
+
+// cacheKey identifies the resized data for the image. It uses
+// the image digest when there is one, so replacing an image
+// never serves a stale resize.
+func (ro ResizeOptions) cacheKey(i *Image) string {
+	id := i.Digest
+	if id == "" {
+		id = fmt.Sprintf("g%d-%s-%d", i.GalleryID, i.Filename, i.UpdatedAt.Unix())
+		id = digest([]byte(id))
+	}
+	return fmt.Sprintf("%s-%dx%d-%s", id, ro.Width, ro.Height, ro.Fit)
+}
+
+// validateResize fills in the default fit and makes sure the
+// requested size is one of the allowed sizes, so nobody can
+// make us create (and cache) every size there is.
+func (is *imageService) validateResize(ro *ResizeOptions) error {
+	if ro.Fit == "" {
+		ro.Fit = FitContain
+	}
+	if ro.Fit != FitContain && ro.Fit != FitCover {
+		return ErrResizeInvalid
+	}
+	if ro.Width == 0 && ro.Height == 0 {
+		return ErrResizeInvalid
+	}
+	if ro.Fit == FitCover && (ro.Width == 0 || ro.Height == 0) {
+		return ErrResizeInvalid
+	}
+	for _, n := range []int{ro.Width, ro.Height} {
+		if n != 0 && !containsInt(is.cfg.ResizeSizes, n) {
+			return ErrResizeInvalid
+		}
+	}
+	return nil
+}
+
+func containsInt(ns []int, n int) bool {
+	for _, v := range ns {
+		if v == n {
+			return true
+		}
+	}
+	return false
+}
+
+// Resize returns the image resized as described by ro. The
+// result is kept in the resize cache, if there is one, and
+// concurrent requests for the same resize share the work.
+func (is *imageService) Resize(i *Image, ro ResizeOptions) (io.ReadCloser, error) {
+	if err := is.validateResize(&ro); err != nil {
+		return nil, err
+	}
+	key := ro.cacheKey(i)
+	if is.cfg.ResizeCache != nil {
+		if f, err := is.cfg.ResizeCache.Get(key); err == nil {
+			return f, nil
+		}
+	}
+	data, err := is.resizes.do(key, func() ([]byte, error) {
+		data, err := is.resize(i, ro)
+		if err != nil {
+			return nil, err
+		}
+		if is.cfg.ResizeCache != nil {
+			// A failure to cache just means the next request has
+			// to resize the image again.
+			is.cfg.ResizeCache.Put(key, data)
+		}
+		return data, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return nopSeekCloser{bytes.NewReader(data)}, nil
+}
+
+func (is *imageService) resize(i *Image, ro ResizeOptions) ([]byte, error) {
+	rc, err := is.Open(i, "")
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	data, err := ioutil.ReadAll(rc)
+	if err != nil {
+		return nil, err
+	}
+	src, format, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err := encodeImage(&buf, resizeTo(src, ro), format); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// resizeTo scales src as described by ro.
+func resizeTo(src image.Image, ro ResizeOptions) image.Image {
+	b := src.Bounds()
+	w, h := float64(b.Dx()), float64(b.Dy())
+	sx, sy := float64(ro.Width)/w, float64(ro.Height)/h
+	var scale float64
+	switch {
+	case ro.Fit == FitCover:
+		scale = math.Max(sx, sy)
+	case ro.Width == 0:
+		scale = sy
+	case ro.Height == 0:
+		scale = sx
+	default:
+		scale = math.Min(sx, sy)
+	}
+	if scale >= 1 {
+		scale = 1
+	}
+	dw := math.Max(math.Round(w*scale), 1)
+	dh := math.Max(math.Round(h*scale), 1)
+	// With cover we only keep the center of the scaled image,
+	// so we work out which part of src that is and never scale
+	// pixels we would crop anyway.
+	crop := b
+	if ro.Fit == FitCover {
+		dw = math.Min(dw, float64(ro.Width))
+		dh = math.Min(dh, float64(ro.Height))
+		cw, ch := int(math.Round(dw/scale)), int(math.Round(dh/scale))
+		x := b.Min.X + (b.Dx()-cw)/2
+		y := b.Min.Y + (b.Dy()-ch)/2
+		crop = image.Rect(x, y, x+cw, y+ch).Intersect(b)
+	}
+	if crop == b && int(dw) == b.Dx() && int(dh) == b.Dy() {
+		return src
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, int(dw), int(dh)))
+	draw.CatmullRom.Scale(dst, dst.Bounds(), src, crop, draw.Over, nil)
+	return dst
+}
+
+type nopSeekCloser struct {
+	io.ReadSeeker
+}
+
+func (nopSeekCloser) Close() error {
+	return nil
+}
+
+// flightGroup makes sure only one call for each key is in
+// flight at a time. Callers that ask for a key that is already
+// being worked on wait for, and share, its result.
+type flightGroup struct {
+	mu    sync.Mutex
+	calls map[string]*flightCall
+}
+
+type flightCall struct {
+	wg   sync.WaitGroup
+	data []byte
+	err  error
+}
+
+func (fg *flightGroup) do(key string, fn func() ([]byte, error)) ([]byte, error) {
+	fg.mu.Lock()
+	if fg.calls == nil {
+		fg.calls = make(map[string]*flightCall)
+	}
+	if c, ok := fg.calls[key]; ok {
+		fg.mu.Unlock()
+		c.wg.Wait()
+		return c.data, c.err
+	}
+	c := &flightCall{}
+	c.wg.Add(1)
+	fg.calls[key] = c
+	fg.mu.Unlock()
+
+	c.data, c.err = fn()
+	c.wg.Done()
+
+	fg.mu.Lock()
+	delete(fg.calls, key)
+	fg.mu.Unlock()
+	return c.data, c.err
+}
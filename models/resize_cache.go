@@ -0,0 +1,169 @@
+package models
+
+import (
+	"container/list"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// ResizeCache keeps images resized on request in a directory
+// on disk. Once the files add up to more than its size cap the
+// least recently used ones are removed.
+type ResizeCache struct {
+	dir      string
+	maxBytes int64
+
+	mu      sync.Mutex
+	size    int64
+	lru     *list.List // of *cacheEntry, most recently used first
+	entries map[string]*list.Element
+}
+
+type cacheEntry struct {
+	key  string
+	size int64
+}
+
+// NewResizeCache returns a ResizeCache that keeps at most
+// maxBytes of files in dir. Files left in dir by an earlier
+// run are picked up again, oldest first, so the cache survives
+// restarts.
+func NewResizeCache(dir string, maxBytes int64) (*ResizeCache, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	rc := &ResizeCache{
+		dir:      dir,
+		maxBytes: maxBytes,
+		lru:      list.New(),
+		entries:  make(map[string]*list.Element),
+	}
+	// Newest first, so the newest files are at the front of the
+	// list just like they would have been before the restart.
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].ModTime().After(infos[j].ModTime())
+	})
+	for _, fi := range infos {
+		if !fi.Mode().IsRegular() {
+			continue
+		}
+		if filepath.Ext(fi.Name()) == ".tmp" {
+			// Left behind by a Put that never finished.
+			os.Remove(filepath.Join(dir, fi.Name()))
+			continue
+		}
+		rc.entries[fi.Name()] = rc.lru.PushBack(&cacheEntry{
+			key:  fi.Name(),
+			size: fi.Size(),
+		})
+		rc.size += fi.Size()
+	}
+	rc.mu.Lock()
+	rc.evict()
+	rc.mu.Unlock()
+	return rc, nil
+}
+
+// Get opens the cached file for key, returning ErrNotFound if
+// it isn't in the cache.
+func (rc *ResizeCache) Get(key string) (*os.File, error) {
+	rc.mu.Lock()
+	el, ok := rc.entries[key]
+	if ok {
+		rc.lru.MoveToFront(el)
+	}
+	rc.mu.Unlock()
+	if !ok {
+		return nil, ErrNotFound
+	}
+	f, err := os.Open(rc.path(key))
+	if os.IsNotExist(err) {
+		return nil, ErrNotFound
+	}
+	return f, err
+}
+
+// Put adds data to the cache under key, removing the least
+// recently used files if the cache grows past its size cap.
+func (rc *ResizeCache) Put(key string, data []byte) error {
+	if int64(len(data)) > rc.maxBytes {
+		return nil
+	}
+	// The file is written under a temporary name first so that
+	// Get never opens a half written file.
+	tmp, err := ioutil.TempFile(rc.dir, key+".*.tmp")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(data)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), rc.path(key))
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	if el, ok := rc.entries[key]; ok {
+		rc.size -= el.Value.(*cacheEntry).size
+		rc.lru.Remove(el)
+	}
+	rc.entries[key] = rc.lru.PushFront(&cacheEntry{
+		key:  key,
+		size: int64(len(data)),
+	})
+	rc.size += int64(len(data))
+	rc.evict()
+	return nil
+}
+
+// RemovePrefix removes every file whose key starts with prefix.
+func (rc *ResizeCache) RemovePrefix(prefix string) error {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	for key, el := range rc.entries {
+		if !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		rc.lru.Remove(el)
+		delete(rc.entries, key)
+		rc.size -= el.Value.(*cacheEntry).size
+		if err := os.Remove(rc.path(key)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// evict removes the least recently used files until the cache
+// fits in its size cap. rc.mu must be held.
+func (rc *ResizeCache) evict() {
+	for rc.size > rc.maxBytes {
+		el := rc.lru.Back()
+		if el == nil {
+			return
+		}
+		e := el.Value.(*cacheEntry)
+		rc.lru.Remove(el)
+		delete(rc.entries, e.key)
+		rc.size -= e.size
+		// Anybody still reading the file keeps their copy.
+		os.Remove(rc.path(e.key))
+	}
+}
+
+func (rc *ResizeCache) path(key string) string {
+	return filepath.Join(rc.dir, key)
+}
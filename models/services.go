@@ -1,6 +1,10 @@
 package models
 
-import "github.com/jinzhu/gorm"
+import (
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
 
 // ServicesConfig is really just a function, but I find using
 // types like this are easier to read in my source code.
@@ -57,18 +61,87 @@ func WithGallery() ServicesConfig {
 	}
 }
 
-func WithImage() ServicesConfig {
+func WithImage(cfg ImageConfig) ServicesConfig {
 	return func(s *Services) error {
-		s.Image = NewImageService()
+		if cfg.Collision != "" && !cfg.Collision.valid() {
+			return ErrCollisionPolicyInvalid
+		}
+		s.Image = NewImageService(s.db, cfg)
+		return nil
+	}
+}
+
+// WithJobs sets up the job queue. Jobs are only run by a
+// WorkerPool, which has to be started separately.
+func WithJobs() ServicesConfig {
+	return func(s *Services) error {
+		s.Job = NewJobService(s.db)
+		return nil
+	}
+}
+
+// WithShareLinks sets up share links. Link passwords are
+// peppered like user passwords, and the grants remembering
+// visitors are signed with the HMAC key.
+func WithShareLinks(pepper, hmacKey string) ServicesConfig {
+	return func(s *Services) error {
+		s.ShareLink = NewShareLinkService(s.db, pepper, hmacKey)
 		return nil
 	}
 }
 
 type Services struct {
-	Gallery GalleryService
-	User    UserService
-	Image   ImageService
-	db      *gorm.DB
+	Gallery   GalleryService
+	User      UserService
+	Image     ImageService
+	Job       JobService
+	ShareLink ShareLinkService
+	db        *gorm.DB
+}
+
+// PurgeGallery removes a gallery for good, along with all of
+// its images and their files. The images go first so that a
+// failure part way through can simply be retried.
+func (s *Services) PurgeGallery(id uint) error {
+	if err := s.Image.DeleteByGalleryID(id); err != nil {
+		return err
+	}
+	return s.Gallery.Purge(id)
+}
+
+// PurgeDeletedGalleries purges every gallery that was deleted
+// before t, returning how many were purged.
+func (s *Services) PurgeDeletedGalleries(t time.Time) (int, error) {
+	galleries, err := s.Gallery.DeletedBefore(t)
+	if err != nil {
+		return 0, err
+	}
+	for i, g := range galleries {
+		if err := s.PurgeGallery(g.ID); err != nil {
+			return i, err
+		}
+	}
+	return len(galleries), nil
+}
+
+// PurgeTrash purges the galleries and images that were moved
+// to the trash before t, returning how many of each were
+// purged.
+func (s *Services) PurgeTrash(t time.Time) (galleries, images int, err error) {
+	galleries, err = s.PurgeDeletedGalleries(t)
+	if err != nil {
+		return galleries, 0, err
+	}
+	deleted, err := s.Image.DeletedBefore(t)
+	if err != nil {
+		return galleries, 0, err
+	}
+	for i := range deleted {
+		if err := s.Image.Purge(&deleted[i]); err != nil {
+			return galleries, i, err
+		}
+	}
+	return galleries, len(deleted), nil
 }
 
 // Closes the database connection
@@ -78,12 +151,42 @@ func (s *Services) Close() error {
 
 // AutoMigrate will attempt to automatically migrate all tables
 func (s *Services) AutoMigrate() error {
-	return s.db.AutoMigrate(&User{}, &Gallery{}, &pwReset{}).Error
+	err := s.db.AutoMigrate(&User{}, &Gallery{}, &Image{}, &blob{},
+		&storageUsage{}, &pwReset{}, &Job{}, &ShareLink{}).Error
+	if err != nil {
+		return err
+	}
+	// Filenames only have to be unique among the images that
+	// aren't in the trash, which gorm's tags can't express.
+	err = s.db.Exec(`DROP INDEX IF EXISTS idx_gallery_filename`).Error
+	if err != nil {
+		return err
+	}
+	err = s.db.Exec(`CREATE UNIQUE INDEX IF NOT EXISTS idx_images_live_filename
+		ON images (gallery_id, filename) WHERE deleted_at IS NULL`).Error
+	if err != nil {
+		return err
+	}
+	err = s.db.Exec(`CREATE UNIQUE INDEX IF NOT EXISTS idx_galleries_slug
+		ON galleries (slug) WHERE slug <> ''`).Error
+	if err != nil {
+		return err
+	}
+	// Users that uploaded images before we tracked storage
+	// usage start out with the size of their existing images.
+	// Images in the trash still take up space until they are
+	// purged, which is when their size is released, so they
+	// count as well.
+	return s.db.Exec(`INSERT INTO storage_usages (user_id, used, quota, updated_at)
+		SELECT user_id, SUM(size), 0, NOW() FROM images
+		GROUP BY user_id
+		ON CONFLICT (user_id) DO NOTHING`).Error
 }
 
 // DestructiveReset drops all tables and rebuilds them
 func (s *Services) DestructiveReset() error {
-	err := s.db.DropTableIfExists(&User{}, &Gallery{}, &pwReset{}).Error
+	err := s.db.DropTableIfExists(&User{}, &Gallery{}, &Image{}, &blob{},
+		&storageUsage{}, &pwReset{}, &Job{}, &ShareLink{}).Error
 	if err != nil {
 		return err
 	}
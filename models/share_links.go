@@ -0,0 +1,462 @@
+package models
+
+import (
+	"crypto/hmac"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"golang.org/x/crypto/bcrypt"
+
+	"github.com/yakushou730/golang-web-course/hash"
+	"github.com/yakushou730/golang-web-course/rand"
+)
+
+const (
+	// ShareGrantTTL is how long a visitor is remembered after
+	// opening a share link, unless the link expires sooner.
+	ShareGrantTTL = 7 * 24 * time.Hour
+
+	// maxShareLinkLabel is the longest label we accept.
+	maxShareLinkLabel = 100
+
+	// maxShareLinkFailures is how many wrong passwords can be
+	// tried for a link within shareLinkLockout before Unlock
+	// stops checking them until the rest of it has passed.
+	maxShareLinkFailures = 5
+	shareLinkLockout     = 15 * time.Minute
+
+	ErrShareLinkExpired  modelError = "models: this share link has expired"
+	ErrShareLinkRevoked  modelError = "models: this share link was revoked"
+	ErrShareLinkUsedUp   modelError = "models: this share link has been opened too many times"
+	ErrShareLinkPassword modelError = "models: the password for this share link " +
+		"is not correct"
+	ErrShareLinkExpiryInvalid modelError = "models: share links must expire " +
+		"in the future"
+	ErrShareLinkMaxViewsInvalid modelError = "models: the view limit can't be negative"
+	ErrShareLinkLabelTooLong    modelError = "models: share link labels must be " +
+		"at most 100 characters long"
+	ErrShareGrantInvalid modelError = "models: the share link grant is not valid"
+	ErrShareLinkLocked   modelError = "models: too many wrong passwords were " +
+		"tried for this share link, please try again later"
+)
+
+// ShareLink lets people who aren't allowed to see a gallery
+// otherwise see it anyway, by following a link with a random
+// token in it. A link can expire, be limited to a number of
+// views, need a password, and be revoked by the gallery owner.
+//
+// Only a hash of the token is stored, like a remember token,
+// so the link can only be shown to the owner when it is
+// created.
+type ShareLink struct {
+	gorm.Model
+	GalleryID uint `gorm:"not_null;index"`
+	// Label helps the owner tell their links apart, eg. the name
+	// of the client they sent it to.
+	Label     string
+	Token     string `gorm:"-"`
+	TokenHash string `gorm:"not_null;unique_index"`
+	// Password is only set when creating a link. It is stored
+	// as a bcrypt hash, and links without one don't need one.
+	Password     string `gorm:"-"`
+	PasswordHash string
+	// ExpiresAt is when the link stops working, or nil if it
+	// never does.
+	ExpiresAt *time.Time
+	// MaxViews is how many times the link can be opened, or 0
+	// for no limit, and Views is how many times it has been.
+	// Visitors are remembered once they opened it, see Grant, so
+	// they only count once.
+	MaxViews  int `gorm:"not_null;default:0"`
+	Views     int `gorm:"not_null;default:0"`
+	RevokedAt *time.Time
+}
+
+// HasPassword reports whether the link needs a password.
+func (sl *ShareLink) HasPassword() bool {
+	return sl.PasswordHash != ""
+}
+
+// Check returns ErrShareLinkRevoked, ErrShareLinkExpired or
+// ErrShareLinkUsedUp if the link can't be used anymore.
+func (sl *ShareLink) Check() error {
+	switch {
+	case sl.RevokedAt != nil:
+		return ErrShareLinkRevoked
+	case sl.ExpiresAt != nil && !time.Now().Before(*sl.ExpiresAt):
+		return ErrShareLinkExpired
+	case sl.MaxViews > 0 && sl.Views >= sl.MaxViews:
+		return ErrShareLinkUsedUp
+	}
+	return nil
+}
+
+// Status describes whether the link can still be used, for
+// showing it to the owner.
+func (sl *ShareLink) Status() string {
+	switch sl.Check() {
+	case nil:
+		return "Active"
+	case ErrShareLinkRevoked:
+		return "Revoked"
+	case ErrShareLinkExpired:
+		return "Expired"
+	default:
+		return "Used up"
+	}
+}
+
+// ShareLinkService is used to create share links and let
+// visitors use them.
+type ShareLinkService interface {
+	ShareLinkDB
+	// Unlock checks the password of a link that needs one,
+	// returning ErrShareLinkPassword if it doesn't match. After
+	// too many wrong passwords it returns ErrShareLinkLocked
+	// for a while without checking.
+	Unlock(link *ShareLink, password string) error
+	// Grant returns a value to remember that the visitor opened
+	// the link, which is valid until the given time.
+	Grant(link *ShareLink, until time.Time) string
+	// CheckGrant makes sure a value was returned by Grant and
+	// isn't too old, without looking up the link, and returns
+	// the IDs of the link and its gallery. It returns
+	// ErrShareGrantInvalid if not.
+	CheckGrant(grant string) (linkID, galleryID uint, err error)
+	// ByGrant returns the link a value returned by Grant was
+	// made for. It returns ErrShareGrantInvalid if the value
+	// wasn't made by Grant or is too old, and ErrShareLinkRevoked
+	// or ErrShareLinkExpired if the link stopped working since.
+	ByGrant(grant string) (*ShareLink, error)
+}
+
+// ShareLinkDB is used to interact with the share_links table.
+//
+// For single link queries:
+// If the link is found, we will return a nil err
+// If the link is not found, we will return ErrNotFound
+// If there is another error, we will return an error with
+// more information about what went wrong.
+type ShareLinkDB interface {
+	ByID(id uint) (*ShareLink, error)
+	// ByToken looks up a link by the token in its URL.
+	ByToken(token string) (*ShareLink, error)
+	// ByGalleryID returns every link of the gallery, including
+	// the ones that can't be used anymore, newest first.
+	ByGalleryID(galleryID uint) ([]ShareLink, error)
+	// Create creates a link with a new random Token.
+	Create(link *ShareLink) error
+	// Revoke stops the link from working.
+	Revoke(id uint) error
+	// AddView counts opening the link, returning
+	// ErrShareLinkUsedUp if it has no views left.
+	AddView(link *ShareLink) error
+}
+
+func NewShareLinkService(db *gorm.DB, pepper, hmacKey string) ShareLinkService {
+	return &shareLinkService{
+		ShareLinkDB: &shareLinkValidator{
+			ShareLinkDB: &shareLinkGorm{
+				db: db,
+			},
+			hmacKey: hmacKey,
+			pepper:  pepper,
+		},
+		hmacKey:  hmacKey,
+		pepper:   pepper,
+		failures: make(map[uint]*shareLinkFailures),
+	}
+}
+
+type shareLinkService struct {
+	ShareLinkDB
+	hmacKey string
+	pepper  string
+
+	mu       sync.Mutex
+	failures map[uint]*shareLinkFailures
+}
+
+// shareLinkFailures counts the passwords tried for a link since
+// the first one, until the right one is tried.
+type shareLinkFailures struct {
+	count int
+	since time.Time
+}
+
+type shareLinkValidator struct {
+	ShareLinkDB
+	hmacKey string
+	pepper  string
+}
+
+type shareLinkGorm struct {
+	db *gorm.DB
+}
+
+type shareLinkValFn func(*ShareLink) error
+
+func (ss *shareLinkService) Unlock(link *ShareLink, password string) error {
+	if !link.HasPassword() {
+		return nil
+	}
+	// The attempt is counted before the password is checked,
+	// so guesses sent all at once can't get past the limit.
+	if !ss.attempt(link.ID) {
+		return ErrShareLinkLocked
+	}
+	err := bcrypt.CompareHashAndPassword(
+		[]byte(link.PasswordHash),
+		[]byte(password+ss.pepper),
+	)
+	switch err {
+	case nil:
+		ss.mu.Lock()
+		delete(ss.failures, link.ID)
+		ss.mu.Unlock()
+		return nil
+	case bcrypt.ErrMismatchedHashAndPassword:
+		return ErrShareLinkPassword
+	default:
+		return err
+	}
+}
+
+// attempt counts a password being tried for the link, and
+// reports false if too many were tried recently.
+func (ss *shareLinkService) attempt(id uint) bool {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	f, ok := ss.failures[id]
+	if !ok || time.Since(f.since) > shareLinkLockout {
+		f = &shareLinkFailures{since: time.Now()}
+		ss.failures[id] = f
+	}
+	if f.count >= maxShareLinkFailures {
+		return false
+	}
+	f.count++
+	return true
+}
+
+// Grants look like "<link ID>.<gallery ID>.<expiry>.<signature>",
+// so they can be checked without looking up the link.
+func (ss *shareLinkService) Grant(link *ShareLink, until time.Time) string {
+	expires := until.Unix()
+	return fmt.Sprintf("%d.%d.%d.%s", link.ID, link.GalleryID, expires,
+		ss.grantSignature(link.ID, link.GalleryID, expires))
+}
+
+func (ss *shareLinkService) CheckGrant(grant string) (linkID, galleryID uint, err error) {
+	parts := strings.Split(grant, ".")
+	if len(parts) != 4 {
+		return 0, 0, ErrShareGrantInvalid
+	}
+	var ids [2]uint64
+	for i := range ids {
+		ids[i], err = strconv.ParseUint(parts[i], 10, 64)
+		if err != nil {
+			return 0, 0, ErrShareGrantInvalid
+		}
+	}
+	expires, err := strconv.ParseInt(parts[2], 10, 64)
+	if err != nil || time.Now().Unix() > expires {
+		return 0, 0, ErrShareGrantInvalid
+	}
+	want := ss.grantSignature(uint(ids[0]), uint(ids[1]), expires)
+	if !hmac.Equal([]byte(want), []byte(parts[3])) {
+		return 0, 0, ErrShareGrantInvalid
+	}
+	return uint(ids[0]), uint(ids[1]), nil
+}
+
+func (ss *shareLinkService) ByGrant(grant string) (*ShareLink, error) {
+	id, _, err := ss.CheckGrant(grant)
+	if err != nil {
+		return nil, err
+	}
+	link, err := ss.ByID(id)
+	if err == ErrNotFound {
+		return nil, ErrShareGrantInvalid
+	}
+	if err != nil {
+		return nil, err
+	}
+	// Revoking a link takes access away from everyone who
+	// opened it, but running out of views doesn't.
+	if link.RevokedAt != nil {
+		return nil, ErrShareLinkRevoked
+	}
+	if link.ExpiresAt != nil && !time.Now().Before(*link.ExpiresAt) {
+		return nil, ErrShareLinkExpired
+	}
+	return link, nil
+}
+
+func (ss *shareLinkService) grantSignature(linkID, galleryID uint, expires int64) string {
+	// hash.HMAC reuses its hash.Hash, so we can't share one
+	// between requests.
+	h := hash.NewHMAC(ss.hmacKey)
+	return h.Hash(fmt.Sprintf("share-grant:%d:%d:%d", linkID, galleryID, expires))
+}
+
+func runShareLinkValFns(link *ShareLink, fns ...shareLinkValFn) error {
+	for _, fn := range fns {
+		if err := fn(link); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (sv *shareLinkValidator) ByToken(token string) (*ShareLink, error) {
+	if token == "" {
+		return nil, ErrNotFound
+	}
+	link := ShareLink{Token: token}
+	if err := runShareLinkValFns(&link, sv.hmacToken); err != nil {
+		return nil, err
+	}
+	return sv.ShareLinkDB.ByToken(link.TokenHash)
+}
+
+func (sv *shareLinkValidator) Create(link *ShareLink) error {
+	err := runShareLinkValFns(link,
+		sv.galleryIDRequired,
+		sv.labelValid,
+		sv.expiryValid,
+		sv.maxViewsValid,
+		sv.setToken,
+		sv.hmacToken,
+		sv.bcryptPassword)
+	if err != nil {
+		return err
+	}
+	return sv.ShareLinkDB.Create(link)
+}
+
+func (sv *shareLinkValidator) Revoke(id uint) error {
+	if id <= 0 {
+		return ErrIDInvalid
+	}
+	return sv.ShareLinkDB.Revoke(id)
+}
+
+func (sv *shareLinkValidator) galleryIDRequired(sl *ShareLink) error {
+	if sl.GalleryID <= 0 {
+		return ErrGalleryIDRequired
+	}
+	return nil
+}
+
+func (sv *shareLinkValidator) labelValid(sl *ShareLink) error {
+	sl.Label = strings.TrimSpace(sl.Label)
+	if len([]rune(sl.Label)) > maxShareLinkLabel {
+		return ErrShareLinkLabelTooLong
+	}
+	return nil
+}
+
+func (sv *shareLinkValidator) expiryValid(sl *ShareLink) error {
+	if sl.ExpiresAt != nil && !sl.ExpiresAt.After(time.Now()) {
+		return ErrShareLinkExpiryInvalid
+	}
+	return nil
+}
+
+func (sv *shareLinkValidator) maxViewsValid(sl *ShareLink) error {
+	if sl.MaxViews < 0 {
+		return ErrShareLinkMaxViewsInvalid
+	}
+	sl.Views = 0
+	return nil
+}
+
+func (sv *shareLinkValidator) setToken(sl *ShareLink) error {
+	token, err := rand.RememberToken()
+	if err != nil {
+		return err
+	}
+	sl.Token = token
+	return nil
+}
+
+func (sv *shareLinkValidator) hmacToken(sl *ShareLink) error {
+	if sl.Token == "" {
+		return nil
+	}
+	h := hash.NewHMAC(sv.hmacKey)
+	sl.TokenHash = h.Hash("share-link:" + sl.Token)
+	return nil
+}
+
+func (sv *shareLinkValidator) bcryptPassword(sl *ShareLink) error {
+	if sl.Password == "" {
+		return nil
+	}
+	hashedBytes, err := bcrypt.GenerateFromPassword(
+		[]byte(sl.Password+sv.pepper), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+	sl.PasswordHash = string(hashedBytes)
+	sl.Password = ""
+	return nil
+}
+
+func (sg *shareLinkGorm) ByID(id uint) (*ShareLink, error) {
+	var link ShareLink
+	db := sg.db.Where("id = ?", id)
+	err := first(db, &link)
+	if err != nil {
+		return nil, err
+	}
+	return &link, nil
+}
+
+func (sg *shareLinkGorm) ByToken(tokenHash string) (*ShareLink, error) {
+	var link ShareLink
+	err := first(sg.db.Where("token_hash = ?", tokenHash), &link)
+	if err != nil {
+		return nil, err
+	}
+	return &link, nil
+}
+
+func (sg *shareLinkGorm) ByGalleryID(galleryID uint) ([]ShareLink, error) {
+	var links []ShareLink
+	db := sg.db.Where("gallery_id = ?", galleryID).Order("id DESC")
+	if err := db.Find(&links).Error; err != nil {
+		return nil, err
+	}
+	return links, nil
+}
+
+func (sg *shareLinkGorm) Create(link *ShareLink) error {
+	return sg.db.Create(link).Error
+}
+
+func (sg *shareLinkGorm) Revoke(id uint) error {
+	return sg.db.Model(&ShareLink{}).Where("id = ? AND revoked_at IS NULL", id).
+		Update("revoked_at", time.Now()).Error
+}
+
+func (sg *shareLinkGorm) AddView(link *ShareLink) error {
+	// The limit is checked in the same statement so two
+	// visitors can't both take the last view.
+	db := sg.db.Model(&ShareLink{}).
+		Where("id = ? AND (max_views = 0 OR views < max_views)", link.ID).
+		UpdateColumn("views", gorm.Expr("views + 1"))
+	if db.Error != nil {
+		return db.Error
+	}
+	if db.RowsAffected == 0 {
+		return ErrShareLinkUsedUp
+	}
+	link.Views++
+	return nil
+}
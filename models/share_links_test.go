@@ -0,0 +1,163 @@
+package models
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// fakeShareLinkDB keeps share links in memory, for testing the
+// service on top of it.
+type fakeShareLinkDB struct {
+	ShareLinkDB
+	links map[uint]*ShareLink
+}
+
+func (db *fakeShareLinkDB) ByID(id uint) (*ShareLink, error) {
+	link, ok := db.links[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	c := *link
+	return &c, nil
+}
+
+func newTestShareLinkService(links ...*ShareLink) *shareLinkService {
+	db := &fakeShareLinkDB{links: make(map[uint]*ShareLink)}
+	for _, link := range links {
+		db.links[link.ID] = link
+	}
+	return &shareLinkService{
+		ShareLinkDB: db,
+		hmacKey:     "secret",
+		pepper:      "pepper",
+		failures:    make(map[uint]*shareLinkFailures),
+	}
+}
+
+func TestShareLinkCheck(t *testing.T) {
+	past := time.Now().Add(-time.Minute)
+	future := time.Now().Add(time.Hour)
+	tests := []struct {
+		name string
+		link ShareLink
+		want error
+	}{
+		{"no limits", ShareLink{}, nil},
+		{"not expired", ShareLink{ExpiresAt: &future}, nil},
+		{"expired", ShareLink{ExpiresAt: &past}, ErrShareLinkExpired},
+		{"views left", ShareLink{MaxViews: 3, Views: 2}, nil},
+		{"used up", ShareLink{MaxViews: 3, Views: 3}, ErrShareLinkUsedUp},
+		{"no view limit", ShareLink{Views: 1000}, nil},
+		{"revoked", ShareLink{RevokedAt: &past}, ErrShareLinkRevoked},
+		{"revoked before used up", ShareLink{RevokedAt: &past, MaxViews: 1, Views: 1},
+			ErrShareLinkRevoked},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if err := tc.link.Check(); err != tc.want {
+				t.Errorf("Check() = %v, want %v", err, tc.want)
+			}
+		})
+	}
+}
+
+func TestShareLinkGrant(t *testing.T) {
+	past := time.Now().Add(-time.Minute)
+	active := &ShareLink{GalleryID: 3}
+	active.ID = 1
+	revoked := &ShareLink{GalleryID: 3, RevokedAt: &past}
+	revoked.ID = 2
+	expired := &ShareLink{GalleryID: 3, ExpiresAt: &past}
+	expired.ID = 3
+	usedUp := &ShareLink{GalleryID: 3, MaxViews: 1, Views: 1}
+	usedUp.ID = 4
+	ss := newTestShareLinkService(active, revoked, expired, usedUp)
+	until := time.Now().Add(time.Hour)
+
+	tests := []struct {
+		name  string
+		grant string
+		want  error
+	}{
+		{"valid", ss.Grant(active, until), nil},
+		{"used up links keep their grants", ss.Grant(usedUp, until), nil},
+		{"revoked", ss.Grant(revoked, until), ErrShareLinkRevoked},
+		{"expired link", ss.Grant(expired, until), ErrShareLinkExpired},
+		{"expired grant", ss.Grant(active, time.Now().Add(-time.Second)),
+			ErrShareGrantInvalid},
+		{"missing link", func() string {
+			link := *active
+			link.ID = 99
+			return ss.Grant(&link, until)
+		}(), ErrShareGrantInvalid},
+		{"other gallery", strings.Replace(ss.Grant(active, until), "1.3.", "1.4.", 1),
+			ErrShareGrantInvalid},
+		{"other link", strings.Replace(ss.Grant(active, until), "1.3.", "2.3.", 1),
+			ErrShareGrantInvalid},
+		{"other key", (&shareLinkService{hmacKey: "other"}).Grant(active, until),
+			ErrShareGrantInvalid},
+		{"garbage", "1.3.abc", ErrShareGrantInvalid},
+		{"empty", "", ErrShareGrantInvalid},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			link, err := ss.ByGrant(tc.grant)
+			if err != tc.want {
+				t.Fatalf("ByGrant() = %v, want %v", err, tc.want)
+			}
+			if err == nil && link.ID == 0 {
+				t.Errorf("ByGrant() returned a link without an ID")
+			}
+		})
+	}
+}
+
+func TestShareLinkCheckGrant(t *testing.T) {
+	link := &ShareLink{GalleryID: 7}
+	link.ID = 5
+	ss := newTestShareLinkService()
+	linkID, galleryID, err := ss.CheckGrant(ss.Grant(link, time.Now().Add(time.Hour)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if linkID != 5 || galleryID != 7 {
+		t.Errorf("CheckGrant() = %d, %d, want 5, 7", linkID, galleryID)
+	}
+}
+
+func TestShareLinkUnlock(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("open sesame"+"pepper"),
+		bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	link := &ShareLink{GalleryID: 3, PasswordHash: string(hash)}
+	link.ID = 1
+	ss := newTestShareLinkService(link)
+
+	if err := ss.Unlock(link, "open sesame"); err != nil {
+		t.Fatalf("Unlock() with the password = %v", err)
+	}
+	for i := 0; i < maxShareLinkFailures; i++ {
+		if err := ss.Unlock(link, "guess"); err != ErrShareLinkPassword {
+			t.Fatalf("Unlock() guess %d = %v, want %v", i+1, err, ErrShareLinkPassword)
+		}
+	}
+	if err := ss.Unlock(link, "open sesame"); err != ErrShareLinkLocked {
+		t.Fatalf("Unlock() after too many guesses = %v, want %v", err, ErrShareLinkLocked)
+	}
+	// Once the lockout has passed the password works again.
+	ss.failures[link.ID].since = time.Now().Add(-shareLinkLockout - time.Second)
+	if err := ss.Unlock(link, "open sesame"); err != nil {
+		t.Fatalf("Unlock() after the lockout = %v", err)
+	}
+
+	noPassword := &ShareLink{GalleryID: 3}
+	noPassword.ID = 2
+	if err := ss.Unlock(noPassword, "anything"); err != nil {
+		t.Errorf("Unlock() without a password = %v", err)
+	}
+}
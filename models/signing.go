@@ -0,0 +1,162 @@
+package models
+
+import (
+	"crypto/hmac"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/yakushou730/golang-web-course/hash"
+)
+
+const (
+	// DefaultImageURLTTL is how long a signed image URL stays
+	// valid for when no other TTL is configured.
+	DefaultImageURLTTL = time.Hour
+
+	ErrURLSignatureInvalid modelError = "models: the image URL " +
+		"signature is not valid"
+	ErrURLExpired modelError = "models: the image URL has expired"
+)
+
+// URLSigner signs image URLs with an HMAC so that they can't
+// be guessed, and makes them expire after a while so that a
+// leaked URL doesn't work forever.
+type URLSigner struct {
+	key string
+	ttl time.Duration
+	now func() time.Time
+}
+
+// NewURLSigner returns a URLSigner that signs URLs with key
+// and keeps them valid for at least ttl.
+func NewURLSigner(key string, ttl time.Duration) *URLSigner {
+	if ttl <= 0 {
+		ttl = DefaultImageURLTTL
+	}
+	return &URLSigner{
+		key: key,
+		ttl: ttl,
+		now: time.Now,
+	}
+}
+
+// Sign adds an expiry and a signature to the query string of
+// the URL path p. The signature covers the query parameters
+// already in p, such as the size of a resized image, so they
+// can't be changed or added to later. The expiry is rounded up
+// to the next TTL boundary, so a page rendered twice within the
+// same window gets the same URLs and browsers can keep using
+// their cache.
+func (us *URLSigner) Sign(p string) string {
+	expires := us.now().Truncate(us.ttl).Add(2 * us.ttl).Unix()
+	u, err := url.Parse(p)
+	if err != nil {
+		return p
+	}
+	q := u.Query()
+	sig := us.signature(u.Path, q, expires)
+	q.Set("expires", strconv.FormatInt(expires, 10))
+	q.Set("sig", sig)
+	u.RawQuery = q.Encode()
+	return u.String()
+}
+
+// Verify checks the signature in the query of a request for
+// the URL path p, returning ErrURLSignatureInvalid or
+// ErrURLExpired if it shouldn't be served.
+func (us *URLSigner) Verify(p string, query url.Values) error {
+	expires, err := strconv.ParseInt(query.Get("expires"), 10, 64)
+	if err != nil {
+		return ErrURLSignatureInvalid
+	}
+	want := us.signature(p, query, expires)
+	if !hmac.Equal([]byte(want), []byte(query.Get("sig"))) {
+		return ErrURLSignatureInvalid
+	}
+	if us.now().Unix() > expires {
+		return ErrURLExpired
+	}
+	return nil
+}
+
+// signature signs the path along with every query parameter
+// but the signature and expiry themselves.
+func (us *URLSigner) signature(p string, query url.Values, expires int64) string {
+	params := make(url.Values, len(query))
+	for k, v := range query {
+		if k != "sig" && k != "expires" {
+			params[k] = v
+		}
+	}
+	// hash.HMAC reuses its hash.Hash, so we can't share one
+	// between the requests signing URLs concurrently.
+	h := hash.NewHMAC(us.key)
+	// Encode sorts the parameters, so their order in the URL
+	// doesn't matter.
+	return h.Hash("image-url:" + p + "?" + params.Encode() + ":" +
+		strconv.FormatInt(expires, 10))
+}
+
+// signedPath signs p if the image was loaded by a service that
+// signs URLs, otherwise p is returned as is.
+func (i *Image) signedPath(p string) string {
+	if i.signer == nil {
+		return p
+	}
+	return i.signer.Sign(p)
+}
+
+// imageURLSigner hands its URLSigner to every image it loads
+// so that the paths built by those images are signed.
+type imageURLSigner struct {
+	ImageDB
+	signer *URLSigner
+}
+
+func (ius *imageURLSigner) sign(images []Image) []Image {
+	for i := range images {
+		images[i].signer = ius.signer
+	}
+	return images
+}
+
+func (ius *imageURLSigner) one(image *Image, err error) (*Image, error) {
+	if image != nil {
+		image.signer = ius.signer
+	}
+	return image, err
+}
+
+func (ius *imageURLSigner) ByID(id uint) (*Image, error) {
+	return ius.one(ius.ImageDB.ByID(id))
+}
+
+func (ius *imageURLSigner) ByFilename(galleryID uint, filename string) (*Image, error) {
+	return ius.one(ius.ImageDB.ByFilename(galleryID, filename))
+}
+
+func (ius *imageURLSigner) ByGalleryID(galleryID uint) ([]Image, error) {
+	images, err := ius.ImageDB.ByGalleryID(galleryID)
+	return ius.sign(images), err
+}
+
+func (ius *imageURLSigner) ByIDs(ids []uint) ([]Image, error) {
+	images, err := ius.ImageDB.ByIDs(ids)
+	return ius.sign(images), err
+}
+
+func (ius *imageURLSigner) Search(userID uint, query string) ([]Image, error) {
+	images, err := ius.ImageDB.Search(userID, query)
+	return ius.sign(images), err
+}
+
+func (ius *imageURLSigner) FirstByGalleryIDs(galleryIDs []uint) ([]Image, error) {
+	images, err := ius.ImageDB.FirstByGalleryIDs(galleryIDs)
+	return ius.sign(images), err
+}
+
+func (ius *imageURLSigner) Create(image *Image) error {
+	image.signer = ius.signer
+	return ius.ImageDB.Create(image)
+}
@@ -0,0 +1,94 @@
+package models
+
+import (
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestURLSigner(t *testing.T) {
+	now := time.Unix(1600000000, 0)
+	signer := NewURLSigner("secret", time.Hour)
+	signer.now = func() time.Time { return now }
+	signed := signer.Sign("/images/galleries/1/photo.jpg?v=abc&w=320")
+
+	tests := []struct {
+		name   string
+		change func(u *url.URL)
+		later  time.Duration
+		key    string
+		want   error
+	}{
+		{"valid", nil, 0, "", nil},
+		{"valid until it expires", nil, time.Hour, "", nil},
+		{"expired", nil, 3 * time.Hour, "", ErrURLExpired},
+		{"other key", nil, 0, "other", ErrURLSignatureInvalid},
+		{"other path", func(u *url.URL) {
+			u.Path = "/images/galleries/2/photo.jpg"
+		}, 0, "", ErrURLSignatureInvalid},
+		{"other variant", func(u *url.URL) {
+			u.Path = "/images/display/galleries/1/photo.jpg"
+		}, 0, "", ErrURLSignatureInvalid},
+		{"changed param", func(u *url.URL) {
+			q := u.Query()
+			q.Set("w", "1920")
+			u.RawQuery = q.Encode()
+		}, 0, "", ErrURLSignatureInvalid},
+		{"added param", func(u *url.URL) {
+			q := u.Query()
+			q.Set("fit", "cover")
+			u.RawQuery = q.Encode()
+		}, 0, "", ErrURLSignatureInvalid},
+		{"removed param", func(u *url.URL) {
+			q := u.Query()
+			q.Del("w")
+			u.RawQuery = q.Encode()
+		}, 0, "", ErrURLSignatureInvalid},
+		{"later expiry", func(u *url.URL) {
+			q := u.Query()
+			q.Set("expires", "9999999999")
+			u.RawQuery = q.Encode()
+		}, 0, "", ErrURLSignatureInvalid},
+		{"no expiry", func(u *url.URL) {
+			q := u.Query()
+			q.Del("expires")
+			u.RawQuery = q.Encode()
+		}, 0, "", ErrURLSignatureInvalid},
+		{"no signature", func(u *url.URL) {
+			q := u.Query()
+			q.Del("sig")
+			u.RawQuery = q.Encode()
+		}, 0, "", ErrURLSignatureInvalid},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			u, err := url.Parse(signed)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tc.change != nil {
+				tc.change(u)
+			}
+			key := tc.key
+			if key == "" {
+				key = "secret"
+			}
+			verifier := NewURLSigner(key, time.Hour)
+			verifier.now = func() time.Time { return now.Add(tc.later) }
+			if err := verifier.Verify(u.Path, u.Query()); err != tc.want {
+				t.Errorf("Verify() = %v, want %v", err, tc.want)
+			}
+		})
+	}
+}
+
+func TestURLSignerStableWithinTTL(t *testing.T) {
+	now := time.Unix(1600000000, 0).Truncate(time.Hour)
+	signer := NewURLSigner("secret", time.Hour)
+	signer.now = func() time.Time { return now }
+	first := signer.Sign("/images/galleries/1/photo.jpg")
+	signer.now = func() time.Time { return now.Add(59 * time.Minute) }
+	if second := signer.Sign("/images/galleries/1/photo.jpg"); second != first {
+		t.Errorf("Sign() = %q within the same TTL, want %q", second, first)
+	}
+}
@@ -0,0 +1,175 @@
+package models
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	ErrStorageKeyInvalid modelError = "models: storage key is not valid"
+)
+
+// Storage is used to store and retrieve the data behind our
+// images. Keys are slash separated paths such as
+// "galleries/1/photo.jpg", no matter which driver is used.
+type Storage interface {
+	// Put stores the data read from r under key, replacing
+	// anything that was already stored there. contentType is
+	// the MIME type of the data, which drivers that serve it
+	// straight to browsers keep along with it.
+	Put(key, contentType string, r io.Reader) error
+	// Get returns the data stored under key. If nothing is
+	// stored there ErrNotFound is returned. The returned
+	// reader may also implement io.Seeker.
+	Get(key string) (io.ReadCloser, error)
+	// Delete removes the data stored under key. Deleting a key
+	// that doesn't exist is not an error.
+	Delete(key string) error
+	// List returns every key that starts with prefix.
+	List(prefix string) ([]string, error)
+	// URL returns a URL the data stored under key can be
+	// downloaded from directly, or an empty string if it has
+	// to be served by our application.
+	URL(key string) string
+}
+
+// NewLocalStorage returns a Storage that keeps everything in
+// files under the dir directory on the local disk.
+func NewLocalStorage(dir string) Storage {
+	return &localStorage{dir: dir}
+}
+
+type localStorage struct {
+	dir string
+}
+
+// path converts a storage key into a path on disk, making
+// sure that the path can never end up outside of our dir.
+func (ls *localStorage) path(key string) (string, error) {
+	path := filepath.Join(ls.dir, filepath.FromSlash(key))
+	rel, err := filepath.Rel(ls.dir, path)
+	if err != nil {
+		return "", err
+	}
+	if rel == "." || rel == ".." ||
+		strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", ErrStorageKeyInvalid
+	}
+	return path, nil
+}
+
+// Put ignores contentType, since our application works it out
+// when serving the file.
+func (ls *localStorage) Put(key, contentType string, r io.Reader) error {
+	path, err := ls.path(key)
+	if err != nil {
+		return err
+	}
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	// Write to a temp file first and then rename it so nobody
+	// ever reads a partially written file.
+	tmp, err := ioutil.TempFile(dir, ".tmp-")
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(tmp, r)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(tmp.Name(), 0644)
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return nil
+}
+
+func (ls *localStorage) Get(key string) (io.ReadCloser, error) {
+	path, err := ls.path(key)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if fi.IsDir() {
+		f.Close()
+		return nil, ErrNotFound
+	}
+	return f, nil
+}
+
+func (ls *localStorage) Delete(key string) error {
+	path, err := ls.path(key)
+	if err != nil {
+		return err
+	}
+	err = os.Remove(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	// Remove any directories the file leaves empty, so deleted
+	// galleries and blobs don't leave a trail of them behind.
+	// os.Remove refuses to remove a directory that isn't empty.
+	root := filepath.Clean(ls.dir)
+	for dir := filepath.Dir(path); dir != root && strings.HasPrefix(dir, root); dir = filepath.Dir(dir) {
+		if os.Remove(dir) != nil {
+			break
+		}
+	}
+	return nil
+}
+
+func (ls *localStorage) List(prefix string) ([]string, error) {
+	var keys []string
+	err := filepath.Walk(ls.dir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if fi.IsDir() || strings.HasPrefix(fi.Name(), ".tmp-") {
+			return nil
+		}
+		rel, err := filepath.Rel(ls.dir, path)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(rel)
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+// URL always returns an empty string because files on our
+// local disk are served by the application itself.
+func (ls *localStorage) URL(key string) string {
+	return ""
+}
@@ -0,0 +1,109 @@
+package models
+
+import (
+	"io"
+	"net/url"
+	"strings"
+
+	minio "github.com/minio/minio-go/v6"
+)
+
+// S3Config is used to connect to an S3 compatible object store
+// such as AWS S3 or MinIO.
+type S3Config struct {
+	Endpoint  string
+	AccessKey string
+	SecretKey string
+	Bucket    string
+	Region    string
+	UseSSL    bool
+	// PublicURL is optional. If it is set, images are
+	// downloaded straight from PublicURL + "/" + key instead of
+	// being served by our application, so the bucket (or the
+	// CDN in front of it) must allow public reads.
+	PublicURL string
+}
+
+// NewS3Storage returns a Storage that keeps everything in an
+// S3 compatible bucket. The bucket is created if it doesn't
+// already exist.
+func NewS3Storage(cfg S3Config) (Storage, error) {
+	client, err := minio.NewWithRegion(cfg.Endpoint, cfg.AccessKey,
+		cfg.SecretKey, cfg.UseSSL, cfg.Region)
+	if err != nil {
+		return nil, err
+	}
+	exists, err := client.BucketExists(cfg.Bucket)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		if err := client.MakeBucket(cfg.Bucket, cfg.Region); err != nil {
+			return nil, err
+		}
+	}
+	return &s3Storage{
+		client:    client,
+		bucket:    cfg.Bucket,
+		publicURL: strings.TrimSuffix(cfg.PublicURL, "/"),
+	}, nil
+}
+
+type s3Storage struct {
+	client    *minio.Client
+	bucket    string
+	publicURL string
+}
+
+func (ss *s3Storage) Put(key, contentType string, r io.Reader) error {
+	// Blob keys have no extension, so without the content type
+	// browsers sent to the URL of a key would download the
+	// image rather than show it.
+	opts := minio.PutObjectOptions{
+		ContentType: contentType,
+	}
+	_, err := ss.client.PutObject(ss.bucket, key, r, -1, opts)
+	return err
+}
+
+func (ss *s3Storage) Get(key string) (io.ReadCloser, error) {
+	obj, err := ss.client.GetObject(ss.bucket, key, minio.GetObjectOptions{})
+	if err != nil {
+		return nil, err
+	}
+	// GetObject doesn't talk to the server until the object is
+	// first used, so we stat it to find missing keys up front.
+	if _, err := obj.Stat(); err != nil {
+		obj.Close()
+		if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+	return obj, nil
+}
+
+func (ss *s3Storage) Delete(key string) error {
+	return ss.client.RemoveObject(ss.bucket, key)
+}
+
+func (ss *s3Storage) List(prefix string) ([]string, error) {
+	done := make(chan struct{})
+	defer close(done)
+	var keys []string
+	for obj := range ss.client.ListObjectsV2(ss.bucket, prefix, true, done) {
+		if obj.Err != nil {
+			return nil, obj.Err
+		}
+		keys = append(keys, obj.Key)
+	}
+	return keys, nil
+}
+
+func (ss *s3Storage) URL(key string) string {
+	if ss.publicURL == "" {
+		return ""
+	}
+	u := url.URL{Path: "/" + key}
+	return ss.publicURL + u.EscapedPath()
+}
@@ -0,0 +1,226 @@
+package models
+
+import (
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/jinzhu/gorm"
+)
+
+// Orphan is image data, or an image record, that nothing
+// refers to any more. Key is set for files in Storage and
+// ImageID for image records whose gallery no longer exists.
+type Orphan struct {
+	Key     string
+	ImageID uint
+	Reason  string
+}
+
+func (o Orphan) String() string {
+	if o.Key != "" {
+		return fmt.Sprintf("%s: %s", o.Key, o.Reason)
+	}
+	return fmt.Sprintf("image %d: %s", o.ImageID, o.Reason)
+}
+
+// orphanDB is used to find out what the data in Storage should
+// belong to.
+type orphanDB interface {
+	// GalleryIDs returns the ID of every gallery, including the
+	// ones that were deleted but not purged yet.
+	GalleryIDs() (map[uint]bool, error)
+	// LegacyKeys returns the gallery ID and filename of every
+	// image stored before we started using blobs, as
+	// "galleryID/filename".
+	LegacyKeys() (map[string]bool, error)
+	// BlobDigests returns the digest of every blob.
+	BlobDigests() (map[string]bool, error)
+	// ImagesWithoutGallery returns the images whose gallery no
+	// longer exists at all.
+	ImagesWithoutGallery() ([]Image, error)
+}
+
+type orphanGorm struct {
+	db *gorm.DB
+}
+
+func (og *orphanGorm) GalleryIDs() (map[uint]bool, error) {
+	var ids []uint
+	err := og.db.Unscoped().Model(&Gallery{}).Pluck("id", &ids).Error
+	if err != nil {
+		return nil, err
+	}
+	set := make(map[uint]bool, len(ids))
+	for _, id := range ids {
+		set[id] = true
+	}
+	return set, nil
+}
+
+func (og *orphanGorm) LegacyKeys() (map[string]bool, error) {
+	rows, err := og.db.Unscoped().Model(&Image{}).
+		Where("digest = '' OR digest IS NULL").
+		Select("gallery_id, filename").Rows()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	set := make(map[string]bool)
+	for rows.Next() {
+		var galleryID uint
+		var filename string
+		if err := rows.Scan(&galleryID, &filename); err != nil {
+			return nil, err
+		}
+		set[fmt.Sprintf("%d/%s", galleryID, filename)] = true
+	}
+	return set, rows.Err()
+}
+
+func (og *orphanGorm) BlobDigests() (map[string]bool, error) {
+	var digests []string
+	if err := og.db.Model(&blob{}).Pluck("digest", &digests).Error; err != nil {
+		return nil, err
+	}
+	set := make(map[string]bool, len(digests))
+	for _, d := range digests {
+		set[d] = true
+	}
+	return set, nil
+}
+
+func (og *orphanGorm) ImagesWithoutGallery() ([]Image, error) {
+	var images []Image
+	err := og.db.Unscoped().
+		Where("gallery_id NOT IN (?)", og.db.Unscoped().Table("galleries").Select("id").QueryExpr()).
+		Find(&images).Error
+	if err != nil {
+		return nil, err
+	}
+	return images, nil
+}
+
+// Orphans looks for files in Storage that no image or blob
+// refers to, and for images whose gallery no longer exists.
+// Galleries that were deleted but not purged yet still own
+// their images, since they can be restored. Keys that don't
+// look like anything we store are left alone.
+func (is *imageService) Orphans() ([]Orphan, error) {
+	galleries, err := is.orphans.GalleryIDs()
+	if err != nil {
+		return nil, err
+	}
+	legacy, err := is.orphans.LegacyKeys()
+	if err != nil {
+		return nil, err
+	}
+	blobs, err := is.orphans.BlobDigests()
+	if err != nil {
+		return nil, err
+	}
+	keys, err := is.store.List("")
+	if err != nil {
+		return nil, err
+	}
+	var orphans []Orphan
+	for _, key := range keys {
+		if reason := orphanReason(key, galleries, legacy, blobs); reason != "" {
+			orphans = append(orphans, Orphan{Key: key, Reason: reason})
+		}
+	}
+	images, err := is.orphans.ImagesWithoutGallery()
+	if err != nil {
+		return nil, err
+	}
+	for _, i := range images {
+		orphans = append(orphans, Orphan{
+			ImageID: i.ID,
+			Reason:  fmt.Sprintf("gallery %d does not exist", i.GalleryID),
+		})
+	}
+	return orphans, nil
+}
+
+// orphanReason returns why the file stored under key is an
+// orphan, or an empty string if it isn't one.
+func orphanReason(key string, galleries map[uint]bool, legacy, blobs map[string]bool) string {
+	parts := strings.Split(key, "/")
+	switch {
+	case len(parts) == 4 && parts[0] == "blobs":
+		if !blobs[parts[2]] {
+			return "no image uses this blob"
+		}
+	case len(parts) == 3 && parts[0] == "galleries",
+		len(parts) == 4 && parts[1] == "galleries":
+		n := len(parts)
+		id, err := strconv.ParseUint(parts[n-2], 10, 64)
+		if err != nil {
+			return ""
+		}
+		if !galleries[uint(id)] {
+			return fmt.Sprintf("gallery %d does not exist", id)
+		}
+		if !legacy[path.Join(parts[n-2], parts[n-1])] {
+			return "no image uses this file"
+		}
+	}
+	return ""
+}
+
+// RemoveOrphan removes an orphan found by Orphans.
+func (is *imageService) RemoveOrphan(o Orphan) error {
+	if o.Key != "" {
+		return is.store.Delete(o.Key)
+	}
+	i, err := is.orphanImage(o.ImageID)
+	if err != nil {
+		return err
+	}
+	return is.Purge(i)
+}
+
+func (is *imageService) orphanImage(id uint) (*Image, error) {
+	images, err := is.orphans.ImagesWithoutGallery()
+	if err != nil {
+		return nil, err
+	}
+	for i := range images {
+		if images[i].ID == id {
+			return &images[i], nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+// DeleteByGalleryID purges every image in the gallery, including
+// those in the trash, along with its watermarks and any files
+// left behind in the gallery's directories.
+func (is *imageService) DeleteByGalleryID(galleryID uint) error {
+	images, err := is.AllByGalleryID(galleryID)
+	if err != nil {
+		return err
+	}
+	for i := range images {
+		if err := is.Purge(&images[i]); err != nil {
+			return err
+		}
+	}
+	prefixes := []string{galleryDir(galleryID) + "/", watermarkDir(galleryID) + "/"}
+	for _, v := range is.cfg.Variants {
+		prefixes = append(prefixes, variantDir(v.Name, galleryID)+"/")
+	}
+	for _, prefix := range prefixes {
+		keys, err := is.store.List(prefix)
+		if err != nil {
+			return err
+		}
+		for _, key := range keys {
+			if err := is.store.Delete(key); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
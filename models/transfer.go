@@ -0,0 +1,131 @@
+package models
+
+import (
+	"github.com/jinzhu/gorm"
+)
+
+// Copy adds a copy of the image to another gallery. The copy
+// shares the image data with the original, so only the record
+// is duplicated, but it still counts towards the user's storage
+// quota. If the gallery already has an image with the same
+// filename the copy is renamed, eg "photo-1.jpg".
+func (is *imageService) Copy(i *Image, galleryID uint) (*Image, error) {
+	if i.Digest == "" {
+		return is.copyData(i, galleryID)
+	}
+	image := *i
+	image.Model = gorm.Model{}
+	image.GalleryID = galleryID
+	image.Position = 0
+	// The copy shares its variants with the original, and
+	// SetProcessed marks every image with the same digest as
+	// done, so Processing is kept as it is.
+	if err := is.renameToFree(&image); err != nil {
+		return nil, err
+	}
+	if err := is.reserveStorage(&image, nil); err != nil {
+		return nil, err
+	}
+	if _, err := is.blobs.Acquire(image.Digest, image.Size); err != nil {
+		is.releaseStorage(&image, nil)
+		return nil, err
+	}
+	if err := is.ImageDB.Create(&image); err != nil {
+		is.releaseBlob(image.Digest)
+		is.releaseStorage(&image, nil)
+		return nil, err
+	}
+	return &image, nil
+}
+
+// copyData copies an image stored before we started using
+// blobs. Its files live in its gallery's directory, so the data
+// is uploaded again, which also turns it into a blob.
+func (is *imageService) copyData(i *Image, galleryID uint) (*Image, error) {
+	rc, err := is.Open(i, "")
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	image := Image{
+		GalleryID: galleryID,
+		UserID:    i.UserID,
+		Filename:  i.Filename,
+		Title:     i.Title,
+		Caption:   i.Caption,
+		AltText:   i.AltText,
+		// Whatever was stripped from the original is already
+		// gone, and whatever is left the owner chose to keep.
+		KeepGPS: true,
+	}
+	if err := is.renameToFree(&image); err != nil {
+		return nil, err
+	}
+	if err := is.Create(&image, rc); err != nil {
+		return nil, err
+	}
+	return &image, nil
+}
+
+// Move moves the image to another gallery, putting it after
+// the images already there. If the gallery already has an
+// image with the same filename the image is renamed, eg
+// "photo-1.jpg". If the image was the cover of its old gallery
+// that gallery goes back to using its first image.
+func (is *imageService) Move(i *Image, galleryID uint) error {
+	if i.GalleryID == galleryID {
+		return nil
+	}
+	if i.Digest == "" {
+		image, err := is.copyData(i, galleryID)
+		if err != nil {
+			return err
+		}
+		if err := is.Purge(i); err != nil {
+			return err
+		}
+		*i = *image
+		return nil
+	}
+	moved := *i
+	moved.GalleryID = galleryID
+	if err := is.renameToFree(&moved); err != nil {
+		return err
+	}
+	if err := is.ImageDB.Move(&moved); err != nil {
+		return err
+	}
+	*i = moved
+	return nil
+}
+
+func (ig *imageGorm) Move(image *Image) error {
+	tx := ig.db.Begin()
+	if tx.Error != nil {
+		return tx.Error
+	}
+	err := tx.Model(&Gallery{}).
+		Where("cover_image_id = ? AND id <> ?", image.ID, image.GalleryID).
+		UpdateColumn("cover_image_id", 0).Error
+	if err == nil {
+		row := tx.Model(&Image{}).
+			Where("gallery_id = ?", image.GalleryID).
+			Select("COALESCE(MAX(position), 0)").Row()
+		var max int
+		err = row.Scan(&max)
+		image.Position = max + 1
+	}
+	if err == nil {
+		err = tx.Model(&Image{}).Where("id = ?", image.ID).
+			UpdateColumns(map[string]interface{}{
+				"gallery_id": image.GalleryID,
+				"filename":   image.Filename,
+				"position":   image.Position,
+			}).Error
+	}
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit().Error
+}
@@ -0,0 +1,341 @@
+package models
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/yakushou730/golang-web-course/rand"
+)
+
+const (
+	// DefaultUploadExpiry is how long an unfinished upload is
+	// kept around when the UploadStore isn't told otherwise.
+	DefaultUploadExpiry = 7 * 24 * time.Hour
+	// uploadLockTimeout is how long a request can work on an
+	// upload before its lock is assumed to be left behind.
+	uploadLockTimeout = time.Hour
+
+	ErrUploadOffset modelError = "models: the upload offset " +
+		"does not match the data received so far"
+	ErrUploadTooLarge modelError = "models: the upload is larger " +
+		"than the size it was created with"
+	ErrUploadBusy modelError = "models: the upload is already " +
+		"receiving data"
+	ErrUploadExpired modelError = "models: the upload has expired"
+)
+
+// Upload is an image being uploaded in pieces, so that an
+// upload that gets interrupted can carry on where it stopped
+// instead of starting over.
+type Upload struct {
+	ID        string    `json:"id"`
+	GalleryID uint      `json:"gallery_id"`
+	UserID    uint      `json:"user_id"`
+	Filename  string    `json:"filename"`
+	Length    int64     `json:"length"`
+	CreatedAt time.Time `json:"created_at"`
+	// Offset is how many bytes have been received so far. It is
+	// worked out from the data on disk rather than stored.
+	Offset int64 `json:"-"`
+}
+
+// Done reports whether all of the upload's data was received.
+func (u *Upload) Done() bool {
+	return u.Offset >= u.Length
+}
+
+// UploadStore keeps unfinished uploads in a directory on disk
+// so they survive restarts. Each upload is stored as an info
+// file describing it and a data file holding what has been
+// received so far, plus a lock file while a request is working
+// on it. When several instances of the app run, they must
+// share the directory so that any of them can carry on with an
+// upload, and the lock files keep them from working on the same
+// upload at once.
+type UploadStore struct {
+	dir    string
+	expiry time.Duration
+}
+
+// NewUploadStore returns an UploadStore keeping its uploads in
+// dir. Uploads that were started more than expiry ago can no
+// longer be used, and RemoveExpired should be called every so
+// often so abandoned uploads don't fill up the disk.
+func NewUploadStore(dir string, expiry time.Duration) (*UploadStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	if expiry <= 0 {
+		expiry = DefaultUploadExpiry
+	}
+	us := &UploadStore{
+		dir:    dir,
+		expiry: expiry,
+	}
+	return us, nil
+}
+
+// Create starts a new upload. The ID, CreatedAt and Offset of
+// the upload are set by Create.
+func (us *UploadStore) Create(u *Upload) error {
+	b, err := rand.Bytes(16)
+	if err != nil {
+		return err
+	}
+	u.ID = hex.EncodeToString(b)
+	u.CreatedAt = time.Now()
+	u.Offset = 0
+	f, err := os.OpenFile(us.dataPath(u.ID), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	f.Close()
+	if err := us.writeInfo(u); err != nil {
+		os.Remove(us.dataPath(u.ID))
+		return err
+	}
+	return nil
+}
+
+// ByID returns the upload with the given ID, or ErrNotFound.
+// Uploads that are past their expiry return ErrUploadExpired,
+// even if RemoveExpired didn't get to them yet.
+func (us *UploadStore) ByID(id string) (*Upload, error) {
+	u, err := us.read(id)
+	if err != nil {
+		return nil, err
+	}
+	if us.expired(u) {
+		return nil, ErrUploadExpired
+	}
+	return u, nil
+}
+
+// read returns the upload with the given ID whether or not it
+// has expired.
+func (us *UploadStore) read(id string) (*Upload, error) {
+	if !validUploadID(id) {
+		return nil, ErrNotFound
+	}
+	b, err := ioutil.ReadFile(us.infoPath(id))
+	if os.IsNotExist(err) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	var u Upload
+	if err := json.Unmarshal(b, &u); err != nil {
+		return nil, err
+	}
+	fi, err := os.Stat(us.dataPath(id))
+	if os.IsNotExist(err) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	u.Offset = fi.Size()
+	return &u, nil
+}
+
+// Append writes the data read from r to the end of the upload,
+// which must be at offset. It stops reading once the upload
+// reaches its Length and returns ErrUploadTooLarge if r had
+// more data than that. Whatever was written before an error is
+// kept, so the client can resume from the new offset.
+func (us *UploadStore) Append(u *Upload, offset int64, r io.Reader) error {
+	if err := us.lock(u.ID); err != nil {
+		return err
+	}
+	defer us.unlock(u.ID)
+	f, err := os.OpenFile(us.dataPath(u.ID), os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	u.Offset = fi.Size()
+	if offset != u.Offset {
+		return ErrUploadOffset
+	}
+	n, err := io.Copy(f, io.LimitReader(r, u.Length-u.Offset))
+	u.Offset += n
+	if err != nil {
+		return err
+	}
+	// Check whether the client sent more than it said it would.
+	var b [1]byte
+	if n, _ := r.Read(b[:]); n > 0 {
+		return ErrUploadTooLarge
+	}
+	return f.Sync()
+}
+
+// Finish hands the data of a completed upload to fn and then
+// removes the upload, whether or not fn worked, since sending
+// the same data again wouldn't change the outcome. Only one
+// request can finish an upload: while it is being finished
+// Append and Finish return ErrUploadBusy, and once it is done
+// Finish returns ErrNotFound.
+func (us *UploadStore) Finish(u *Upload, fn func(r io.Reader) error) error {
+	if err := us.lock(u.ID); err != nil {
+		return err
+	}
+	defer us.unlock(u.ID)
+	// The upload may have been finished by another request
+	// between looking it up and getting here.
+	if _, err := os.Stat(us.infoPath(u.ID)); os.IsNotExist(err) {
+		return ErrNotFound
+	}
+	defer us.remove(u)
+	f, err := os.Open(us.dataPath(u.ID))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return fn(f)
+}
+
+// Delete removes the upload and its data. It returns
+// ErrUploadBusy if the upload is receiving data or being
+// finished.
+func (us *UploadStore) Delete(u *Upload) error {
+	if err := us.lock(u.ID); err != nil {
+		return err
+	}
+	defer us.unlock(u.ID)
+	return us.remove(u)
+}
+
+func (us *UploadStore) remove(u *Upload) error {
+	if err := os.Remove(us.infoPath(u.ID)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.Remove(us.dataPath(u.ID)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// RemoveExpired removes uploads that were started more than
+// the expiry ago and never finished. Uploads still receiving
+// data are left for the next time.
+func (us *UploadStore) RemoveExpired() error {
+	infos, err := filepath.Glob(filepath.Join(us.dir, "*.info"))
+	if err != nil {
+		return err
+	}
+	for _, p := range infos {
+		id := filepath.Base(p[:len(p)-len(".info")])
+		u, err := us.read(id)
+		if err != nil || !us.expired(u) {
+			continue
+		}
+		if err := us.Delete(u); err != nil && err != ErrUploadBusy {
+			return err
+		}
+	}
+	// An instance that stopped while finishing an upload can
+	// leave its lock behind without the upload.
+	locks, err := filepath.Glob(filepath.Join(us.dir, "*.lock"))
+	if err != nil {
+		return err
+	}
+	for _, p := range locks {
+		fi, err := os.Stat(p)
+		if err != nil || time.Since(fi.ModTime()) < uploadLockTimeout {
+			continue
+		}
+		if _, err := os.Stat(p[:len(p)-len(".lock")] + ".info"); os.IsNotExist(err) {
+			os.Remove(p)
+		}
+	}
+	return nil
+}
+
+func (us *UploadStore) expired(u *Upload) bool {
+	return time.Since(u.CreatedAt) > us.expiry
+}
+
+// Expires returns when the upload will be removed if it
+// isn't finished by then.
+func (us *UploadStore) Expires(u *Upload) time.Time {
+	return u.CreatedAt.Add(us.expiry)
+}
+
+func (us *UploadStore) writeInfo(u *Upload) error {
+	b, err := json.Marshal(u)
+	if err != nil {
+		return err
+	}
+	tmp := us.infoPath(u.ID) + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, us.infoPath(u.ID))
+}
+
+// lock creates the lock file of the upload, returning
+// ErrUploadBusy if somebody else holds it. Creating the file
+// fails if it exists, even when another instance creates it at
+// the same time. A lock older than uploadLockTimeout was left
+// behind by an instance that stopped while holding it, and is
+// taken over.
+func (us *UploadStore) lock(id string) error {
+	p := us.lockPath(id)
+	for retried := false; ; retried = true {
+		f, err := os.OpenFile(p, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+		if err == nil {
+			return f.Close()
+		}
+		if !os.IsExist(err) {
+			return err
+		}
+		fi, err := os.Stat(p)
+		if os.IsNotExist(err) && !retried {
+			// It was unlocked in the meantime.
+			continue
+		}
+		if err != nil || retried || time.Since(fi.ModTime()) < uploadLockTimeout {
+			return ErrUploadBusy
+		}
+		if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+}
+
+func (us *UploadStore) unlock(id string) {
+	os.Remove(us.lockPath(id))
+}
+
+func (us *UploadStore) lockPath(id string) string {
+	return filepath.Join(us.dir, id+".lock")
+}
+
+func (us *UploadStore) infoPath(id string) string {
+	return filepath.Join(us.dir, id+".info")
+}
+
+func (us *UploadStore) dataPath(id string) string {
+	return filepath.Join(us.dir, id+".bin")
+}
+
+// validUploadID makes sure an ID from a request is one we
+// could have created before it is used in a file path.
+func validUploadID(id string) bool {
+	if len(id) != 32 {
+		return false
+	}
+	_, err := hex.DecodeString(id)
+	return err == nil
+}
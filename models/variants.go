@@ -0,0 +1,228 @@
+package models
+
+import (
+	"bytes"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"io/ioutil"
+	"path"
+
+	"golang.org/x/image/draw"
+)
+
+const (
+	// ThumbVariant is the name of the small variant used when
+	// listing images, eg on the gallery edit page.
+	ThumbVariant = "thumb"
+	// DisplayVariant is the name of the variant used when
+	// showing an image as part of a gallery.
+	DisplayVariant = "display"
+
+	jpegQuality = 85
+)
+
+// ImageVariant describes a resized copy of every uploaded
+// image. Images are scaled down to fit inside a MaxSize by
+// MaxSize box, keeping their aspect ratio. Images that are
+// already smaller than that are never scaled up.
+type ImageVariant struct {
+	Name    string
+	MaxSize int
+}
+
+// DefaultImageVariants returns the variants the templates
+// expect to exist for every image.
+func DefaultImageVariants() []ImageVariant {
+	return []ImageVariant{
+		{Name: ThumbVariant, MaxSize: 200},
+		{Name: DisplayVariant, MaxSize: 1200},
+	}
+}
+
+// JobImageVariants is the kind of job that creates the
+// variants of an uploaded image.
+const JobImageVariants = "image.variants"
+
+// variantsJob is the payload of a JobImageVariants job.
+// Variants belong to a blob rather than an image, so every
+// image using the blob is done at once.
+type variantsJob struct {
+	Digest string `json:"digest"`
+}
+
+// queueVariants queues a job to create the variants of the
+// image, which was just created with the given data. If the
+// job can't be queued the variants are created right away
+// instead, since the image would never be done otherwise.
+func (is *imageService) queueVariants(i *Image, data []byte) error {
+	job := Job{
+		Kind:      JobImageVariants,
+		GalleryID: i.GalleryID,
+		ImageID:   i.ID,
+	}
+	// A replaced image is saved with Update, which leaves
+	// Processing alone, so we set it here. It has to be set
+	// before the job is queued, or the job could finish first.
+	err := is.SetProcessing(i.ID)
+	if err == nil {
+		err = job.Encode(variantsJob{Digest: i.Digest})
+	}
+	if err == nil {
+		err = is.jobs.Enqueue(&job)
+	}
+	if err == nil {
+		return nil
+	}
+	if err := is.createVariants(i, data); err != nil {
+		return err
+	}
+	i.Processing = false
+	return is.SetProcessed(i.Digest)
+}
+
+func (is *imageService) ProcessVariants(job *Job) error {
+	var vj variantsJob
+	if err := job.Decode(&vj); err != nil {
+		return err
+	}
+	i := Image{Digest: vj.Digest}
+	rc, err := is.store.Get(blobKey(vj.Digest, originalVariant))
+	if err == ErrNotFound {
+		// Every image using the blob was purged before we got to
+		// it, so there is nothing left to do.
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	data, err := ioutil.ReadAll(rc)
+	if err != nil {
+		return err
+	}
+	if err := is.createVariants(&i, data); err != nil {
+		return err
+	}
+	return is.SetProcessed(vj.Digest)
+}
+
+// createVariants decodes the original image data and stores
+// every configured variant.
+func (is *imageService) createVariants(i *Image, data []byte) error {
+	src, format, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	for _, v := range is.cfg.Variants {
+		if err := is.createVariant(i, v, src, format); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (is *imageService) createVariant(i *Image, v ImageVariant, src image.Image, format string) error {
+	key, err := i.variantKey(v.Name)
+	if err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	if err := encodeImage(&buf, resize(src, v.MaxSize), format); err != nil {
+		return err
+	}
+	// Variants are encoded in the format of the original.
+	return is.store.Put(key, i.ContentType, &buf)
+}
+
+// removeVariants removes every variant of the image from
+// storage. Variants that don't exist are ignored.
+func (is *imageService) removeVariants(i *Image) error {
+	for _, v := range is.cfg.Variants {
+		key, err := i.variantKey(v.Name)
+		if err != nil {
+			return err
+		}
+		if err := is.store.Delete(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// resize scales src down so that it fits inside a maxSize by
+// maxSize box. If src already fits it is returned as is.
+func resize(src image.Image, maxSize int) image.Image {
+	b := src.Bounds()
+	w, h := b.Dx(), b.Dy()
+	if maxSize <= 0 || (w <= maxSize && h <= maxSize) {
+		return src
+	}
+	if w >= h {
+		h = h * maxSize / w
+		w = maxSize
+	} else {
+		w = w * maxSize / h
+		h = maxSize
+	}
+	if w < 1 {
+		w = 1
+	}
+	if h < 1 {
+		h = 1
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	draw.CatmullRom.Scale(dst, dst.Bounds(), src, b, draw.Over, nil)
+	return dst
+}
+
+// encodeImage writes img to w using the format returned by
+// image.Decode. Anything that isn't a png is written as a jpeg.
+func encodeImage(w io.Writer, img image.Image, format string) error {
+	if format == "png" {
+		return png.Encode(w, img)
+	}
+	return jpeg.Encode(w, img, &jpeg.Options{Quality: jpegQuality})
+}
+
+// ThumbPath is used to build the path to the thumbnail of
+// this image via a web request.
+func (i *Image) ThumbPath() string {
+	return i.VariantPath(ThumbVariant)
+}
+
+// DisplayPath is used to build the path to the display sized
+// copy of this image via a web request.
+func (i *Image) DisplayPath() string {
+	return i.VariantPath(DisplayVariant)
+}
+
+// VariantPath is used to build the path to the named variant
+// of this image via a web request.
+func (i *Image) VariantPath(name string) string {
+	return i.urlPath(imageURLPath(path.Join(variantDir(name, i.GalleryID), i.Filename)))
+}
+
+// variantKey is the storage key of the named variant, or of
+// the original image when name is empty. Images stored before
+// we started using blobs keep their variants outside of the
+// gallery so they can never clash with an upload.
+func (i *Image) variantKey(name string) (string, error) {
+	if i.Digest != "" {
+		if name == "" {
+			name = originalVariant
+		}
+		return blobKey(i.Digest, name), nil
+	}
+	if name == "" {
+		return containedPath(galleryDir(i.GalleryID), i.Filename)
+	}
+	return containedPath(variantDir(name, i.GalleryID), i.Filename)
+}
+
+// variantDir is the storage key prefix of the named variants
+// of every image in a gallery.
+func variantDir(name string, galleryID uint) string {
+	return path.Join(name, galleryDir(galleryID))
+}
@@ -0,0 +1,315 @@
+package models
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"io/ioutil"
+	"math"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/image/draw"
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/basicfont"
+	"golang.org/x/image/math/fixed"
+)
+
+// The places a watermark can be drawn.
+const (
+	WatermarkTopLeft     = "top-left"
+	WatermarkTopRight    = "top-right"
+	WatermarkBottomLeft  = "bottom-left"
+	WatermarkBottomRight = "bottom-right"
+	WatermarkCenter      = "center"
+)
+
+// WatermarkPositions lists every valid
+// Gallery.WatermarkPosition.
+var WatermarkPositions = []string{WatermarkTopLeft, WatermarkTopRight,
+	WatermarkBottomLeft, WatermarkBottomRight, WatermarkCenter}
+
+const (
+	// maxWatermarkText is the longest watermark text we accept,
+	// and maxWatermarkBytes and maxWatermarkDimension the
+	// largest watermark PNG.
+	maxWatermarkText      = 100
+	maxWatermarkBytes     = 2 << 20 // 2 megabytes
+	maxWatermarkDimension = 4000
+
+	ErrWatermarkPositionInvalid modelError = "models: watermark position is not valid"
+	ErrWatermarkOpacityInvalid  modelError = "models: watermark opacity must be " +
+		"between 1 and 100"
+	ErrWatermarkTextTooLong modelError = "models: watermark text must be at " +
+		"most 100 characters long"
+	ErrWatermarkRequired modelError = "models: add some watermark text " +
+		"or a PNG image to use a watermark"
+	ErrWatermarkFormat modelError = "models: the watermark must be a PNG " +
+		"image of at most 2 MB"
+)
+
+// HasWatermark reports whether the gallery's images are
+// watermarked.
+func (g *Gallery) HasWatermark() bool {
+	return g.WatermarkEnabled && (g.WatermarkKey != "" || g.WatermarkText != "")
+}
+
+// WatermarkVersion identifies the gallery's watermark
+// settings. It changes whenever they do, so it is part of the
+// key of every watermarked image we cache.
+func (g *Gallery) WatermarkVersion() string {
+	return digest([]byte(fmt.Sprintf("%q %q %q %d",
+		g.WatermarkText, g.WatermarkKey, g.WatermarkPosition,
+		g.WatermarkOpacity)))[:16]
+}
+
+func (gv *galleryValidator) watermarkValid(g *Gallery) error {
+	g.WatermarkText = strings.TrimSpace(g.WatermarkText)
+	if utf8.RuneCountInString(g.WatermarkText) > maxWatermarkText {
+		return ErrWatermarkTextTooLong
+	}
+	if g.WatermarkPosition == "" {
+		g.WatermarkPosition = WatermarkBottomRight
+	}
+	valid := false
+	for _, p := range WatermarkPositions {
+		if g.WatermarkPosition == p {
+			valid = true
+		}
+	}
+	if !valid {
+		return ErrWatermarkPositionInvalid
+	}
+	if g.WatermarkOpacity == 0 {
+		g.WatermarkOpacity = 50
+	}
+	if g.WatermarkOpacity < 1 || g.WatermarkOpacity > 100 {
+		return ErrWatermarkOpacityInvalid
+	}
+	if g.WatermarkEnabled && !g.HasWatermark() {
+		return ErrWatermarkRequired
+	}
+	return nil
+}
+
+// watermarkDir is the storage key prefix of the watermark
+// images of a gallery.
+func watermarkDir(galleryID uint) string {
+	return fmt.Sprintf("watermarks/%d", galleryID)
+}
+
+// watermarkCachePrefix is the prefix of the resize cache keys
+// of every watermarked image in a gallery.
+func watermarkCachePrefix(galleryID uint) string {
+	return fmt.Sprintf("wm-%d-", galleryID)
+}
+
+// StoreWatermark stores the PNG read from r as a watermark for
+// the gallery, returning the key to set as its WatermarkKey.
+// The previous watermark, if any, is left alone so the gallery
+// can keep using it until it is updated.
+func (is *imageService) StoreWatermark(galleryID uint, r io.Reader) (string, error) {
+	data, err := ioutil.ReadAll(io.LimitReader(r, maxWatermarkBytes+1))
+	if err != nil {
+		return "", err
+	}
+	if len(data) > maxWatermarkBytes {
+		return "", ErrWatermarkFormat
+	}
+	cfg, err := png.DecodeConfig(bytes.NewReader(data))
+	if err != nil || cfg.Width > maxWatermarkDimension ||
+		cfg.Height > maxWatermarkDimension {
+		return "", ErrWatermarkFormat
+	}
+	if _, err := png.Decode(bytes.NewReader(data)); err != nil {
+		return "", ErrWatermarkFormat
+	}
+	key := fmt.Sprintf("%s/%s.png", watermarkDir(galleryID), digest(data)[:16])
+	if err := is.store.Put(key, "image/png", bytes.NewReader(data)); err != nil {
+		return "", err
+	}
+	return key, nil
+}
+
+// DeleteWatermark removes a watermark stored by StoreWatermark.
+func (is *imageService) DeleteWatermark(key string) error {
+	if !strings.HasPrefix(key, "watermarks/") {
+		return ErrNotFound
+	}
+	return is.store.Delete(key)
+}
+
+// ClearWatermarks removes the gallery's watermarked images from
+// the resize cache. They would never be served again once the
+// settings change anyway, but this frees the space right away.
+func (is *imageService) ClearWatermarks(galleryID uint) error {
+	if is.cfg.ResizeCache == nil {
+		return nil
+	}
+	return is.cfg.ResizeCache.RemovePrefix(watermarkCachePrefix(galleryID))
+}
+
+// Watermarked returns the named variant of the image, or the
+// original when variant is empty, with the gallery's watermark
+// drawn on it. If ro isn't nil the original is resized first,
+// like Resize does. Results are kept in the resize cache under
+// a key that changes with the watermark settings.
+func (is *imageService) Watermarked(i *Image, g *Gallery, variant string, ro *ResizeOptions) (io.ReadCloser, error) {
+	if ro != nil {
+		if err := is.validateResize(ro); err != nil {
+			return nil, err
+		}
+	}
+	if i.Processing {
+		variant = ""
+	}
+	key := watermarkCacheKey(i, g, variant, ro)
+	if is.cfg.ResizeCache != nil {
+		if f, err := is.cfg.ResizeCache.Get(key); err == nil {
+			return f, nil
+		}
+	}
+	data, err := is.resizes.do(key, func() ([]byte, error) {
+		data, err := is.watermark(i, g, variant, ro)
+		if err != nil {
+			return nil, err
+		}
+		if is.cfg.ResizeCache != nil {
+			is.cfg.ResizeCache.Put(key, data)
+		}
+		return data, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return nopSeekCloser{bytes.NewReader(data)}, nil
+}
+
+func watermarkCacheKey(i *Image, g *Gallery, variant string, ro *ResizeOptions) string {
+	if variant == "" {
+		variant = originalVariant
+	}
+	if ro != nil {
+		// Resized images are always made from the original.
+		variant = originalVariant
+	} else {
+		ro = &ResizeOptions{}
+	}
+	return watermarkCachePrefix(g.ID) + g.WatermarkVersion() + "-" +
+		ro.cacheKey(i) + "-" + variant
+}
+
+func (is *imageService) watermark(i *Image, g *Gallery, variant string, ro *ResizeOptions) ([]byte, error) {
+	var rc io.ReadCloser
+	var err error
+	if ro != nil {
+		rc, err = is.Resize(i, *ro)
+	} else {
+		rc, err = is.Open(i, variant)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	data, err := ioutil.ReadAll(rc)
+	if err != nil {
+		return nil, err
+	}
+	src, format, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	mark, upscale, err := is.watermarkImage(g)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	dst := drawWatermark(src, mark, upscale, g.WatermarkPosition, g.WatermarkOpacity)
+	if err := encodeImage(&buf, dst, format); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// watermarkImage returns the gallery's watermark PNG, or its
+// watermark text rendered as an image. upscale is set for text,
+// which has to be scaled up to be readable.
+func (is *imageService) watermarkImage(g *Gallery) (mark image.Image, upscale bool, err error) {
+	if g.WatermarkKey == "" {
+		return textImage(g.WatermarkText), true, nil
+	}
+	rc, err := is.store.Get(g.WatermarkKey)
+	if err != nil {
+		return nil, false, err
+	}
+	defer rc.Close()
+	mark, err = png.Decode(rc)
+	return mark, false, err
+}
+
+// textImage renders white text with a dark shadow, so it can be
+// read on both light and dark photos. The built in font is
+// tiny, so the result is scaled up by drawWatermark.
+func textImage(text string) image.Image {
+	face := basicfont.Face7x13
+	d := font.Drawer{Face: face}
+	w := d.MeasureString(text).Ceil()
+	dst := image.NewRGBA(image.Rect(0, 0, w+1, face.Height+1))
+	d.Dst = dst
+	for _, c := range []struct {
+		src    image.Image
+		offset int
+	}{{image.NewUniform(color.RGBA{0, 0, 0, 160}), 1}, {image.White, 0}} {
+		d.Src = c.src
+		d.Dot = fixed.P(c.offset, face.Ascent+c.offset)
+		d.DrawString(text)
+	}
+	return dst
+}
+
+// drawWatermark returns a copy of src with mark drawn on it at
+// the given position and opacity, in percent. The mark is
+// scaled to take up a similar part of every image, no matter
+// its size, but it is only made larger than it is if upscale
+// is set.
+func drawWatermark(src, mark image.Image, upscale bool, position string, opacity int) image.Image {
+	b := src.Bounds()
+	dst := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(dst, dst.Bounds(), src, b.Min, draw.Src)
+
+	mb := mark.Bounds()
+	if mb.Empty() {
+		return dst
+	}
+	scale := math.Min(float64(b.Dx())*0.3/float64(mb.Dx()),
+		float64(b.Dy())*0.15/float64(mb.Dy()))
+	if !upscale && scale > 1 {
+		scale = 1
+	}
+	mw := int(math.Max(math.Round(float64(mb.Dx())*scale), 1))
+	mh := int(math.Max(math.Round(float64(mb.Dy())*scale), 1))
+	scaled := image.NewRGBA(image.Rect(0, 0, mw, mh))
+	draw.ApproxBiLinear.Scale(scaled, scaled.Bounds(), mark, mb, draw.Src, nil)
+
+	margin := int(math.Min(float64(b.Dx()), float64(b.Dy())) / 40)
+	var x, y int
+	switch position {
+	case WatermarkTopLeft:
+		x, y = margin, margin
+	case WatermarkTopRight:
+		x, y = b.Dx()-mw-margin, margin
+	case WatermarkBottomLeft:
+		x, y = margin, b.Dy()-mh-margin
+	case WatermarkCenter:
+		x, y = (b.Dx()-mw)/2, (b.Dy()-mh)/2
+	default:
+		x, y = b.Dx()-mw-margin, b.Dy()-mh-margin
+	}
+	r := image.Rect(x, y, x+mw, y+mh)
+	alpha := image.NewUniform(color.Alpha{uint8(opacity * 255 / 100)})
+	draw.DrawMask(dst, r, scaled, image.Point{}, alpha, image.Point{}, draw.Over)
+	return dst
+}
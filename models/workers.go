@@ -0,0 +1,127 @@
+package models
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultWorkers is how many jobs a WorkerPool runs at once
+	// when it isn't told otherwise.
+	DefaultWorkers = 2
+
+	// workerPoll is how long an idle worker waits before
+	// checking for new jobs.
+	workerPoll = time.Second
+	// doneJobTTL is how long jobs are kept around once they are
+	// done.
+	doneJobTTL = 24 * time.Hour
+)
+
+// JobHandler does the work of a job. If it returns an error the
+// job is retried later.
+type JobHandler func(job *Job) error
+
+// WorkerPool runs queued jobs in the background, using a
+// fixed number of goroutines.
+type WorkerPool struct {
+	js       JobService
+	n        int
+	handlers map[string]JobHandler
+
+	quit chan struct{}
+	wg   sync.WaitGroup
+}
+
+// NewWorkerPool returns a WorkerPool running n jobs from js at
+// once. Call Handle for every kind of job, then Start.
+func NewWorkerPool(js JobService, n int) *WorkerPool {
+	if n <= 0 {
+		n = DefaultWorkers
+	}
+	return &WorkerPool{
+		js:       js,
+		n:        n,
+		handlers: make(map[string]JobHandler),
+		quit:     make(chan struct{}),
+	}
+}
+
+// Handle sets the function used to run jobs of the given kind.
+func (wp *WorkerPool) Handle(kind string, h JobHandler) {
+	wp.handlers[kind] = h
+}
+
+// Start starts the workers. They keep running until Stop is
+// called.
+func (wp *WorkerPool) Start() {
+	for i := 0; i < wp.n; i++ {
+		wp.wg.Add(1)
+		go wp.work()
+	}
+	wp.wg.Add(1)
+	go wp.cleanUp()
+}
+
+// Stop tells the workers to stop and waits for the jobs they
+// are running to finish.
+func (wp *WorkerPool) Stop() {
+	close(wp.quit)
+	wp.wg.Wait()
+}
+
+func (wp *WorkerPool) work() {
+	defer wp.wg.Done()
+	for {
+		select {
+		case <-wp.quit:
+			return
+		default:
+		}
+		job, err := wp.js.Claim()
+		if err != nil {
+			// Either there is nothing to do or the database is
+			// unavailable, and either way we wait a bit.
+			select {
+			case <-wp.quit:
+				return
+			case <-time.After(workerPoll):
+			}
+			continue
+		}
+		if err := wp.run(job); err != nil {
+			wp.js.Fail(job, err)
+			continue
+		}
+		wp.js.Complete(job)
+	}
+}
+
+// run runs the job with its handler, turning a panic into an
+// error so one bad job can't take the server down.
+func (wp *WorkerPool) run(job *Job) (err error) {
+	h, ok := wp.handlers[job.Kind]
+	if !ok {
+		return fmt.Errorf("models: no handler for %q jobs", job.Kind)
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("models: %q job panicked: %v", job.Kind, r)
+		}
+	}()
+	return h(job)
+}
+
+// cleanUp removes old jobs that are done every now and then.
+func (wp *WorkerPool) cleanUp() {
+	defer wp.wg.Done()
+	for {
+		wp.js.RemoveDone(time.Now().Add(-doneJobTTL))
+		select {
+		case <-wp.quit:
+			return
+		case <-time.After(time.Hour):
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/yakushou730/golang-web-course/models"
+)
+
+// sweep purges what was moved to the trash longer than
+// purgeAfter ago, if purgeAfter is set, then reports the orphans
+// left in storage. If remove is true the orphans are deleted as
+// well.
+func sweep(services *models.Services, purgeAfter time.Duration, remove bool) error {
+	if purgeAfter > 0 {
+		galleries, images, err := services.PurgeTrash(time.Now().Add(-purgeAfter))
+		fmt.Printf("Purged %d galleries and %d images from the trash\n",
+			galleries, images)
+		if err != nil {
+			return err
+		}
+	}
+	orphans, err := services.Image.Orphans()
+	if err != nil {
+		return err
+	}
+	removed := 0
+	for _, o := range orphans {
+		fmt.Println(o)
+		if !remove {
+			continue
+		}
+		if err := services.Image.RemoveOrphan(o); err != nil {
+			fmt.Printf("  could not remove: %v\n", err)
+			continue
+		}
+		removed++
+	}
+	fmt.Printf("Found %d orphans, removed %d\n", len(orphans), removed)
+	return nil
+}
+
+// purgeTrash purges what was moved to the trash longer than
+// retention ago, checking again every interval. It never
+// returns, so run it in its own goroutine.
+func purgeTrash(services *models.Services, retention, interval time.Duration) {
+	for {
+		galleries, images, err := services.PurgeTrash(time.Now().Add(-retention))
+		if err != nil {
+			log.Println("purging the trash:", err)
+		} else if galleries+images > 0 {
+			log.Printf("Purged %d galleries and %d images from the trash\n",
+				galleries, images)
+		}
+		time.Sleep(interval)
+	}
+}
+
+// removeExpiredUploads removes unfinished uploads that expired,
+// checking again every interval. It never returns, so run it in
+// its own goroutine.
+func removeExpiredUploads(store *models.UploadStore, interval time.Duration) {
+	for {
+		if err := store.RemoveExpired(); err != nil {
+			log.Println("removing expired uploads:", err)
+		}
+		time.Sleep(interval)
+	}
+}
@@ -3,6 +3,7 @@ package views
 import (
 	"bytes"
 	"errors"
+	"fmt"
 	"html/template"
 	"io"
 	"net/http"
@@ -12,6 +13,7 @@ import (
 	"github.com/gorilla/csrf"
 
 	"github.com/yakushou730/golang-web-course/context"
+	"github.com/yakushou730/golang-web-course/models"
 )
 
 type View struct {
@@ -42,6 +44,8 @@ func NewView(layout string, files ...string) *View {
 		"pathEscape": func(s string) string {
 			return url.PathEscape(s)
 		},
+		"imageSize":        imageSize,
+		"imagePlaceholder": imagePlaceholder,
 	}).ParseFiles(files...)
 	if err != nil {
 		panic(err)
@@ -53,6 +57,32 @@ func NewView(layout string, files ...string) *View {
 	}
 }
 
+// imageSize returns the width and height attributes of an img
+// tag showing the image, so the browser can reserve space for
+// it before it loads. Styles that scale images have to set
+// height: auto for the image to keep its shape.
+func imageSize(i *models.Image) template.HTMLAttr {
+	if i == nil || i.Width <= 0 || i.Height <= 0 {
+		return ""
+	}
+	return template.HTMLAttr(fmt.Sprintf(`width="%d" height="%d"`, i.Width, i.Height))
+}
+
+// imagePlaceholder returns the CSS for the style attribute of
+// an img tag that shows the image's placeholder, or its
+// dominant color, until the image has loaded.
+func imagePlaceholder(i *models.Image) template.CSS {
+	if i == nil || i.Color == "" {
+		return ""
+	}
+	css := "background-color: " + i.Color + ";"
+	if i.Placeholder != "" {
+		css += ` background-image: url("` + i.Placeholder + `");` +
+			" background-size: cover;"
+	}
+	return template.CSS(css)
+}
+
 func layoutFiles() []string {
 	files, err := filepath.Glob(LayoutDir + "*" + TemplateExt)
 	if err != nil {